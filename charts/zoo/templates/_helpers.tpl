@@ -0,0 +1,14 @@
+{{- define "zoo.labels" -}}
+app.kubernetes.io/name: {{ .Chart.Name }}
+app.kubernetes.io/instance: {{ .Release.Name }}
+app.kubernetes.io/version: {{ .Chart.AppVersion | quote }}
+app.kubernetes.io/managed-by: {{ .Release.Service }}
+helm.sh/chart: {{ printf "%s-%s" .Chart.Name .Chart.Version }}
+{{- end -}}
+
+{{- define "zoo.dockerconfigjson" -}}
+{{- with .Values.global.ghcrSecret -}}
+{{- $auth := printf "%s:%s" .username .password | b64enc -}}
+{{- dict "auths" (dict "ghcr.io" (dict "username" .username "password" .password "auth" $auth)) | toJson -}}
+{{- end -}}
+{{- end -}}
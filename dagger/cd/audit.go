@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"dagger/cd/internal/dagger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The file of the state repository the deployments are appended to, one JSON
+// entry per line.
+const auditFile = "audit.jsonl"
+
+// The outcomes of a deployment.
+const (
+	deploySucceeded = "succeeded"
+	deployFailed    = "failed"
+)
+
+// auditEntry is a deployment recorded in the audit log, whatever its outcome.
+type auditEntry struct {
+	Time   string        `json:"time"`
+	Actor  string        `json:"actor"`
+	Event  string        `json:"event,omitempty"`
+	Env    Envs          `json:"env"`
+	Sha    string        `json:"sha,omitempty"`
+	Status string        `json:"status"`
+	Error  string        `json:"error,omitempty"`
+	Images []imageChange `json:"images"`
+	// The commit of the deploy branch with the manifests, and what it changed.
+	DeployCommit string `json:"deployCommit,omitempty"`
+	Diff         string `json:"diff,omitempty"`
+}
+
+// imageChange is the image of a container before and after a deployment.
+type imageChange struct {
+	// The workload and its container, such as "Deployment/zoo-backend/backend".
+	Container string `json:"container"`
+	Previous  string `json:"previous"`
+	Current   string `json:"current"`
+}
+
+// podSpec is the part of a pod template needed to know its images.
+type podSpec struct {
+	InitContainers []containerSpec `yaml:"initContainers"`
+	Containers     []containerSpec `yaml:"containers"`
+}
+
+type containerSpec struct {
+	Name  string `yaml:"name"`
+	Image string `yaml:"image"`
+}
+
+// workloadImages returns the image of every container of the workloads in the
+// manifests, by "<kind>/<name>/<container>".
+func workloadImages(data string) (map[string]string, error) {
+	manifests, err := parseManifests(data)
+	if err != nil {
+		return nil, err
+	}
+
+	images := map[string]string{}
+	for _, m := range manifests {
+		var workload struct {
+			Spec struct {
+				Template struct {
+					Spec podSpec `yaml:"spec"`
+				} `yaml:"template"`
+				JobTemplate struct {
+					Spec struct {
+						Template struct {
+							Spec podSpec `yaml:"spec"`
+						} `yaml:"template"`
+					} `yaml:"spec"`
+				} `yaml:"jobTemplate"`
+			} `yaml:"spec"`
+		}
+
+		var pod podSpec
+		switch m.Kind {
+		case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "Job":
+			if err := m.doc.Decode(&workload); err != nil {
+				return nil, fmt.Errorf("parsing %s %q: %w", m.Kind, m.Name, err)
+			}
+			pod = workload.Spec.Template.Spec
+		case "CronJob":
+			if err := m.doc.Decode(&workload); err != nil {
+				return nil, fmt.Errorf("parsing %s %q: %w", m.Kind, m.Name, err)
+			}
+			pod = workload.Spec.JobTemplate.Spec.Template.Spec
+		default:
+			continue
+		}
+
+		for _, c := range append(pod.InitContainers, pod.Containers...) {
+			images[fmt.Sprintf("%s/%s/%s", m.Kind, m.Name, c.Name)] = c.Image
+		}
+	}
+
+	return images, nil
+}
+
+// imageChanges returns the containers whose image is different in the current
+// manifests, sorted by container. The new containers have no previous image.
+func imageChanges(previous, current string) ([]imageChange, error) {
+	before, err := workloadImages(previous)
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := workloadImages(current)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []imageChange
+	for container, image := range after {
+		if before[container] != image {
+			changes = append(changes, imageChange{Container: container, Previous: before[container], Current: image})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Container < changes[j].Container
+	})
+
+	return changes, nil
+}
+
+// recordAudit appends the outcome of the deployment to the audit log, in the
+// main branch of the state repository, and returns the error of the deployment
+// along with the one recording it, if any. It is only called for the
+// deployments that changed something or failed. Another push may land in between,
+// so the entry is appended again on top of it a few times.
+func recordAudit(ctx context.Context, secEnv *dagger.Secret, entry *auditEntry, deployErr error) error {
+	entry.Status = deploySucceeded
+	if deployErr != nil {
+		entry.Status = deployFailed
+		entry.Error = deployErr.Error()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Join(deployErr, err)
+	}
+
+	ctr := dag.
+		Container().
+		From("alpine:3.22").
+		WithExec([]string{"apk", "add", "--no-cache", "git"}).
+		WithExec([]string{"git", "config", "--global", "user.email", "dvieitest@gmail.com"}).
+		WithExec([]string{"git", "config", "--global", "user.name", "Dagger CD Bot"})
+
+	ctr, err = setEnvVariables(ctx, ctr, secEnv)
+	if err != nil {
+		return errors.Join(deployErr, fmt.Errorf("recording the deployment in the audit log: %w", err))
+	}
+
+	script := fmt.Sprintf(`
+		set -eu
+
+		git clone --depth 1 "https://$STATE_REPO@github.com/vieites-tfg/state.git" /state
+		cd /state
+
+		for attempt in 1 2 3; do
+			if [ -s %[1]s ] && [ -n "$(tail -c 1 %[1]s)" ]; then
+				echo >> %[1]s
+			fi
+			cat /tmp/audit.json >> %[1]s
+			echo >> %[1]s
+
+			git add %[1]s
+			git commit -m "chore(audit): deploy to %[2]s"
+			if git push; then
+				exit 0
+			fi
+
+			git fetch --depth 1 origin HEAD
+			git reset --hard FETCH_HEAD
+		done
+
+		exit 1
+	`, auditFile, entry.Env)
+
+	_, err = ctr.
+		WithNewFile("/tmp/audit.json", string(line)).
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{"sh", "-c", script}).
+		Sync(ctx)
+	if err != nil {
+		return errors.Join(deployErr, fmt.Errorf("recording the deployment in the audit log: %w", err))
+	}
+
+	return deployErr
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const deployedManifests = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: zoo-backend
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: wait-mongo
+          image: busybox:1.36
+      containers:
+        - name: backend
+          image: ghcr.io/vieites-tfg/zoo-backend:1a2b3c4d
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: zoo-frontend
+spec:
+  template:
+    spec:
+      containers:
+        - name: frontend
+          image: ghcr.io/vieites-tfg/zoo-frontend:1a2b3c4d
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: zoo-backend
+spec:
+  ports:
+    - port: 3000
+`
+
+func TestImageChanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous string
+		current  string
+		want     []imageChange
+		wantErr  bool
+	}{
+		{
+			name:     "unchanged",
+			previous: deployedManifests,
+			current:  deployedManifests,
+		},
+		{
+			name:    "first deployment",
+			current: deployedManifests,
+			want: []imageChange{
+				{Container: "Deployment/zoo-backend/backend", Current: "ghcr.io/vieites-tfg/zoo-backend:1a2b3c4d"},
+				{Container: "Deployment/zoo-backend/wait-mongo", Current: "busybox:1.36"},
+				{Container: "Deployment/zoo-frontend/frontend", Current: "ghcr.io/vieites-tfg/zoo-frontend:1a2b3c4d"},
+			},
+		},
+		{
+			name:     "new tag",
+			previous: deployedManifests,
+			current: deployedManifests + `---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: zoo-backup
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - name: backup
+              image: mongo:7
+` + "---\n" + `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: zoo-backend
+spec:
+  template:
+    spec:
+      containers:
+        - name: backend
+          image: ghcr.io/vieites-tfg/zoo-backend:5e6f7a8b
+`,
+			want: []imageChange{
+				{Container: "CronJob/zoo-backup/backup", Current: "mongo:7"},
+				{Container: "Deployment/zoo-backend/backend", Previous: "ghcr.io/vieites-tfg/zoo-backend:1a2b3c4d", Current: "ghcr.io/vieites-tfg/zoo-backend:5e6f7a8b"},
+			},
+		},
+		{
+			name:     "invalid manifests",
+			previous: "kind: [",
+			current:  deployedManifests,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := imageChanges(tt.previous, tt.current)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("imageChanges = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
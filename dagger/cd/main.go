@@ -4,7 +4,12 @@ import (
 	"context"
 	"dagger/cd/internal/dagger"
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Cd struct {
@@ -36,6 +41,8 @@ const (
 	PRO Envs = "pro"
 )
 
+var allEnvs = []Envs{DEV, PRE, PRO}
+
 func New(
 	socket *dagger.Socket,
 	kindSvc *dagger.Service,
@@ -77,6 +84,16 @@ func (m *Cd) Base() *dagger.Container {
 		WithExec([]string{"sh", "-c", `
       wget https://github.com/getsops/sops/releases/download/v3.8.1/sops-v3.8.1.linux.amd64 -O /usr/local/bin/sops &&
       chmod a+x /usr/local/bin/sops
+    `}).
+		WithExec([]string{"sh", "-c", `
+      wget https://github.com/FiloSottile/age/releases/download/v1.2.1/age-v1.2.1-linux-amd64.tar.gz &&
+      tar -zxvf age-v1.2.1-linux-amd64.tar.gz &&
+      mv age/age age/age-keygen /usr/local/bin/
+    `}).
+		WithExec([]string{"sh", "-c", `
+      wget https://github.com/bitnami-labs/sealed-secrets/releases/download/v0.27.1/kubeseal-0.27.1-linux-amd64.tar.gz &&
+      tar -zxvf kubeseal-0.27.1-linux-amd64.tar.gz kubeseal &&
+      mv kubeseal /usr/local/bin/
     `})
 }
 func (m *Cd) Cluster(ctx context.Context) *dagger.Container {
@@ -93,12 +110,18 @@ func (m *Cd) Cluster(ctx context.Context) *dagger.Container {
 	helmfileBinary := base.File("/usr/local/bin/helmfile")
 	yqBinary := base.File("/usr/local/bin/yq")
 	sopsBinary := base.File("/usr/local/bin/sops")
+	ageBinary := base.File("/usr/local/bin/age")
+	ageKeygenBinary := base.File("/usr/local/bin/age-keygen")
+	kubesealBinary := base.File("/usr/local/bin/kubeseal")
 
 	clusterClientWithTools := kindClient.
 		WithFile("/usr/local/bin/helm", helmBinary).
 		WithFile("/usr/local/bin/helmfile", helmfileBinary).
 		WithFile("/usr/local/bin/yq", yqBinary).
-		WithFile("/usr/local/bin/sops", sopsBinary)
+		WithFile("/usr/local/bin/sops", sopsBinary).
+		WithFile("/usr/local/bin/age", ageBinary).
+		WithFile("/usr/local/bin/age-keygen", ageKeygenBinary).
+		WithFile("/usr/local/bin/kubeseal", kubesealBinary)
 
 	return clusterClientWithTools.
 		WithExec([]string{"mkdir", "-p", "/app"})
@@ -110,24 +133,116 @@ func (m *Cd) Deploy(
 	// `.env` file with the credentials to use the private images and the variables
 	// related to the mongo database.
 	// +required
-	secEnv *dagger.File,
+	secEnv *dagger.Secret,
 
 	// environment in which the application will be deployed
 	// +required
 	env Envs,
 
-	// AGE private key file (e.g., age.agekey)
-	// +required
+	// AGE private key file (e.g., age.agekey). Needed by the "ksops" backend.
+	// +optional
 	ageKey *dagger.File,
 
-	// .sops.yaml configuration file for SOPS
-	// +required
-	sopsConfig *dagger.File,
+	// AGE public keys the secrets are encrypted for. Defaults to the public key
+	// of `ageKey`.
+	// +optional
+	recipients []string,
 
-	// `helmfile.yaml` necessary to launch the chart.
+	// Regex of the keys whose values are encrypted. Defaults to the values of
+	// the Secrets, "^(data|stringData)$".
 	// +optional
+	encryptedRegex string,
+
+	// `helmfile.yaml` necessary to launch the chart. Defaults to the one of
+	// `charts`, which deploys the `zoo` chart published to `chartsRegistry`
+	// with the values of the state repository.
+	// +defaultPath="/charts/helmfile.yaml.gotmpl"
 	helmfile *dagger.File,
-) (*dagger.Directory, error) {
+
+	// OCI registry the `zoo` chart is pulled from.
+	// +optional
+	// +default="oci://ghcr.io/vieites-tfg/charts"
+	chartsRegistry string,
+
+	// Version of the `zoo` chart. Defaults to the one in the values of the
+	// environment in the state repository.
+	// +optional
+	chartVersion string,
+
+	// How the objects that are not Secrets are split into files: "flat" puts
+	// all of them in `non-secrets.yaml`, "kind" and "component" write one file
+	// per kind or per component into `resources/`.
+	// +optional
+	// +default="flat"
+	layout Layout,
+
+	// How the Secrets reach the cluster: "ksops" commits them encrypted with
+	// sops, "sealed" commits SealedSecrets and "external" commits
+	// ExternalSecrets that read the values from `secretStore`. The cluster must
+	// have the Sealed Secrets controller or the External Secrets Operator for
+	// the last two.
+	// +optional
+	// +default="ksops"
+	secretBackend SecretBackend,
+
+	// Secret backend of each environment, as "env=backend", e.g.
+	// "pro=external". The environments not listed use `secretBackend`.
+	// +optional
+	secretBackends []string,
+
+	// Public certificate of the Sealed Secrets controller. It is fetched from
+	// the cluster when it is not given.
+	// +optional
+	sealingCert *dagger.File,
+
+	// Name of the store the ExternalSecrets read from.
+	// +optional
+	secretStore string,
+
+	// Kind of the store the ExternalSecrets read from.
+	// +optional
+	// +default="ClusterSecretStore"
+	secretStoreKind string,
+
+	// Who deployed, for the audit log.
+	// +optional
+	actor string,
+
+	// The event that triggered the deployment, for the audit log.
+	// +optional
+	event string,
+
+	// The commit of the application that is deployed, for the audit log.
+	// +optional
+	sha string,
+) (_ *dagger.Directory, rerr error) {
+	if actor == "" {
+		actor = "unknown"
+	}
+
+	// The outcome is recorded and notified whether the deployment succeeds or
+	// not, unless it succeeds without changing anything.
+	entry := &auditEntry{
+		Time:  time.Now().UTC().Format(time.RFC3339),
+		Actor: actor,
+		Event: event,
+		Env:   env,
+		Sha:   sha,
+	}
+	defer func() {
+		if rerr == nil && entry.Diff == "" {
+			return
+		}
+
+		rerr = recordAudit(ctx, secEnv, entry, rerr)
+		notify(ctx, secEnv, *entry)
+	}()
+
+	secretBackend, err := backendOf(env, secretBackend, secretBackends)
+	if err != nil {
+		return nil, err
+	}
+
 	ctr := m.Cluster(ctx).
 		WithExec([]string{"apk", "add", "--no-cache", "git"}).
 		WithExec([]string{"git", "clone", "https://github.com/vieites-tfg/state.git", "/app/state"})
@@ -136,112 +251,245 @@ func (m *Cd) Deploy(
 		ctr = ctr.WithFile("/app/state/helmfile.yaml.gotmpl", helmfile)
 	}
 
-	ctr, err := setEnvVariables(ctx, ctr, secEnv)
+	if chartsRegistry == "" {
+		chartsRegistry = "oci://ghcr.io/vieites-tfg/charts"
+	}
+
+	ctr = ctr.WithEnvVariable("CHARTS_REGISTRY", chartsRegistry)
+	if chartVersion != "" {
+		ctr = ctr.WithEnvVariable("CHART_VERSION", chartVersion)
+	}
+
+	ctr, err = setEnvVariables(ctx, ctr, secEnv)
 	if err != nil {
 		return nil, err
 	}
 
-	secretGeneratorFile := `apiVersion: viaduct.ai/v1
-kind: ksops
-metadata:
-  name: secret-generator
-  annotations:
-    config.kubernetes.io/function: |
-      exec:
-        path: ksops
-files:
-  - secrets.yaml # The name of the encrypted files
-`
-
-	kustomizationFile := `apiVersion: kustomize.config.k8s.io/v1beta1
-kind: Kustomization
-resources:
-  - non-secrets.yaml
-generators:
-  - secret_generator.yaml
-`
-
-	processingScript := fmt.Sprintf(`
-		set -euxo pipefail
+	attrs := []attribute.KeyValue{envAttr.String(string(env))}
 
-		echo "--- Templating all resources for environment '%s' ---"
-		helmfile -e %s template > /app/all-objects.yaml
+	var rendered string
 
-		echo "--- Separating secrets from other resources ---"
-		yq 'select(.kind == "Secret")' /app/all-objects.yaml > /app/secrets.yaml
-		yq 'select(.kind != "Secret")' /app/all-objects.yaml > /app/non-secrets.yaml
+	err = stage(ctx, "template", attrs, func(ctx context.Context) error {
+		var err error
 
-		if [ -s /app/secrets.yaml ]; then
-			echo "--- Encrypting secrets with SOPS ---"
-			sops --encrypt --in-place /app/secrets.yaml
-		else
-			echo "--- No secrets found to encrypt ---"
-		fi
+		ctr = ctr.
+			WithWorkdir("/app/state").
+			WithExec([]string{"sh", "-c", fmt.Sprintf("helmfile -e %s template > /app/all-objects.yaml", string(env))})
+
+		rendered, err = ctr.File("/app/all-objects.yaml").Contents(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctr = withDeployBranch(ctr.WithoutFile("/app/all-objects.yaml"))
+
+	var set *manifestSet
+
+	err = stage(ctx, "split", attrs, func(ctx context.Context) error {
+		var err error
+
+		set, err = splitManifests(rendered, layout)
+		if err != nil {
+			return err
+		}
+
+		if set.HasSecrets() {
+			switch secretBackend {
+			case KSOPS, "":
+				err = withKsops(set)
+			case SEALED:
+				if sealingCert == nil {
+					sealingCert = sealingCertOf(ctr)
+				}
+				err = withSealedSecrets(ctx, ctr, set, env, sealingCert, secEnv)
+			case EXTERNAL:
+				err = withExternalSecrets(set, env, secretStore, secretStoreKind)
+			default:
+				err = fmt.Errorf("unknown secret backend %q", secretBackend)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		set.Kustomize()
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := dag.Directory()
+	for _, name := range set.Names() {
+		manifests = manifests.WithNewFile(name, set.Files[name])
+	}
+
+	ctr = ctr.WithDirectory("/app/manifests", manifests)
+
+	if _, ok := set.Files[secretsFile]; ok {
+		if ageKey == nil {
+			return nil, fmt.Errorf("an AGE key is needed to encrypt the secrets with sops")
+		}
+
+		if encryptedRegex == "" {
+			encryptedRegex = defaultEncryptedRegex
+		}
 
-		rm /app/all-objects.yaml
-	`, string(env), string(env))
+		err = stage(ctx, "encrypt", attrs, func(ctx context.Context) error {
+			var err error
 
-	ctr = ctr.
-		WithWorkdir("/app/state").
-		// Config and key
-		WithFile("/app/state/.sops.yaml", sopsConfig).
-		WithExec([]string{"mkdir", "-p", "/root/.config/sops/age/"}).
-		WithFile("/root/.config/sops/age/keys.txt", ageKey).
-		WithEnvVariable("XDG_CONFIG_HOME", "/root/.config").
-		WithNewFile("/app/kustomization.yaml", kustomizationFile).
-		WithNewFile("/app/secret_generator.yaml", secretGeneratorFile).
-		WithExec([]string{"sh", "-c", processingScript})
+			ctr = withAgeKey(ctr, ageKey)
+
+			if len(recipients) == 0 {
+				recipients, err = publicKeys(ctx, ctr, ageKeyPath)
+				if err != nil {
+					return err
+				}
+			}
+
+			ctr, err = encryptSecrets(ctx, ctr, set, env, recipients, encryptedRegex)
+			if err != nil {
+				return err
+			}
+
+			ctr, err = ctr.Sync(ctx)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	commitScript := fmt.Sprintf(`
 		set -euxo pipefail
 
 		NAMESPACE=%s
-		git config --global user.email "dvieitest@gmail.com"
-		git config --global user.name "Dagger CD Bot"
-		
-		echo "--- Cloning state repository ---"
-		REPO_URL="https://$STATE_REPO@github.com/vieites-tfg/state.git"
-		git clone --depth 1 --branch deploy "$REPO_URL" /deploy
-		
+
 		cd /deploy
 		mkdir -p "$NAMESPACE"
 		rm -rf "$NAMESPACE"/* || true
-		
+
 		echo "--- Committing template to state repo ---"
-		mv /app/non-secrets.yaml "$NAMESPACE"/non-secrets.yaml
-		if [ -s /app/secrets.yaml ]; then
-			mv /app/secrets.yaml "$NAMESPACE"/secrets.yaml
-			mv /app/kustomization.yaml "$NAMESPACE"/kustomization.yaml
-			mv /app/secret_generator.yaml "$NAMESPACE"/secret_generator.yaml
-		fi
-		
+		cp -r /app/manifests/. "$NAMESPACE"/
+
 		git add .
 		if git diff --staged --quiet; then
 			echo "No changes to commit."
 		else
 			git commit -m "Update manifests for $NAMESPACE"
-			git push origin deploy
 		fi
 	`, string(env))
 
-	ctr = ctr.WithExec([]string{"sh", "-c", commitScript})
+	// The manifests of the last deployment, without the kustomization and the
+	// generators, which are not Kubernetes objects.
+	previousScript := fmt.Sprintf(`
+		for file in /deploy/%s/%s /deploy/%s/%s/*.yaml; do
+			if [ -f "$file" ]; then
+				cat "$file"
+				echo "---"
+			fi
+		done
+	`, string(env), nonSecretsFile, string(env), resourcesDir)
+
+	err = stage(ctx, "commit", attrs, func(ctx context.Context) error {
+		previous, err := ctr.WithExec([]string{"sh", "-c", previousScript}).Stdout(ctx)
+		if err != nil {
+			return err
+		}
+
+		entry.Images, err = imageChanges(previous, rendered)
+		if err != nil {
+			return err
+		}
+
+		ctr = ctr.WithExec([]string{"sh", "-c", commitScript})
+
+		deployCommit, err := ctr.WithWorkdir("/deploy").WithExec([]string{"git", "rev-parse", "HEAD"}).Stdout(ctx)
+		if err != nil {
+			return err
+		}
+		entry.DeployCommit = strings.TrimSpace(deployCommit)
+		setDigest(ctx, entry.DeployCommit)
+
+		entry.Diff, err = ctr.WithWorkdir("/deploy").WithExec([]string{"git", "diff", "--stat", "origin/deploy", "HEAD"}).Stdout(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing is pushed when there is no new commit.
+	pushScript := `
+		set -eu
+		if [ "$(git rev-parse HEAD)" = "$(git rev-parse origin/deploy)" ]; then
+			echo "Nothing to push."
+		else
+			git push origin deploy
+		fi
+	`
+
+	err = stage(ctx, "push", attrs, func(ctx context.Context) error {
+		var err error
+
+		ctr, err = ctr.
+			WithWorkdir("/deploy").
+			WithExec([]string{"sh", "-c", pushScript}).
+			Sync(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	finalState := ctr.Directory(fmt.Sprintf("/deploy/%s", string(env)))
 
 	return finalState, nil
 }
 
+// withDeployBranch clones the deploy branch of the state repository into
+// `/deploy`, ready to commit and push. It needs the `STATE_REPO` token.
+func withDeployBranch(ctr *dagger.Container) *dagger.Container {
+	return ctr.
+		WithExec([]string{"git", "config", "--global", "user.email", "dvieitest@gmail.com"}).
+		WithExec([]string{"git", "config", "--global", "user.name", "Dagger CD Bot"}).
+		WithExec([]string{"sh", "-c", `
+			echo "--- Cloning state repository ---"
+			git clone --depth 1 --branch deploy "https://$STATE_REPO@github.com/vieites-tfg/state.git" /deploy
+		`})
+}
+
+// setEnvVariables adds the variables of the `.env` to the container as
+// secrets.
 func setEnvVariables(
 	ctx context.Context,
 	ctr *dagger.Container,
-	env *dagger.File,
+	env *dagger.Secret,
 ) (*dagger.Container, error) {
-	envContents, err := env.Contents(ctx)
+	secrets, err := envSecrets(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := slices.Sorted(maps.Keys(secrets))
+	for _, key := range keys {
+		ctr = ctr.WithSecretVariable(key, secrets[key])
+	}
+	return ctr, nil
+}
+
+// envSecrets reads the `KEY=VALUE` lines of the `.env` as secrets, by key.
+func envSecrets(ctx context.Context, env *dagger.Secret) (map[string]*dagger.Secret, error) {
+	envContents, err := env.Plaintext(ctx)
 
 	if err != nil {
 		return nil, err
 	}
 
+	secrets := map[string]*dagger.Secret{}
+
 	lines := strings.SplitSeq(envContents, "\n")
 	for line := range lines {
 		line = strings.TrimSpace(line)
@@ -253,9 +501,8 @@ func setEnvVariables(
 		if len(parts) == 2 {
 			key := parts[0]
 			value := parts[1]
-			secretValue := dag.SetSecret(key, value)
-			ctr = ctr.WithSecretVariable(key, secretValue)
+			secrets[key] = dag.SetSecret(key, value)
 		}
 	}
-	return ctr, nil
+	return secrets, nil
 }
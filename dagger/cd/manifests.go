@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Layout string
+
+const (
+	// Everything that is not a Secret goes into `non-secrets.yaml`.
+	FLAT Layout = "flat"
+	// One file per kind inside `resources/`, e.g. `resources/deployment.yaml`.
+	KIND Layout = "kind"
+	// One file per component inside `resources/`, e.g. `resources/backend.yaml`.
+	COMPONENT Layout = "component"
+)
+
+const (
+	secretsFile         = "secrets.yaml"
+	nonSecretsFile      = "non-secrets.yaml"
+	kustomizationFile   = "kustomization.yaml"
+	secretGeneratorFile = "secret_generator.yaml"
+	resourcesDir        = "resources"
+)
+
+// Labels checked, in order, to know to which component an object belongs.
+var componentLabels = []string{
+	"app.kubernetes.io/component",
+	"app.kubernetes.io/name",
+	"app",
+}
+
+// manifest is one of the Kubernetes objects rendered by helmfile.
+type manifest struct {
+	Kind      string
+	Name      string
+	Namespace string
+	Component string
+
+	// Annotations of the object, used to detect the helm hooks.
+	Annotations map[string]string
+
+	// The whole document, so that the comments and the key order are kept.
+	doc *yaml.Node
+}
+
+type manifestMeta struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name        string            `yaml:"name"`
+		Namespace   string            `yaml:"namespace"`
+		Labels      map[string]string `yaml:"labels"`
+		Annotations map[string]string `yaml:"annotations"`
+	} `yaml:"metadata"`
+}
+
+// manifestSet holds the files to be written in the environment directory of
+// the state repository.
+type manifestSet struct {
+	// File name, relative to the environment directory, and its content.
+	Files map[string]string
+
+	// The Secret objects, kept apart so they can be delivered by the secret
+	// backend of the environment.
+	Secrets []manifest
+
+	// Files and generators listed in the kustomization.
+	Resources  []string
+	Generators []string
+}
+
+// Names returns the file names of the set in a stable order.
+func (s *manifestSet) Names() []string {
+	names := make([]string, 0, len(s.Files))
+	for name := range s.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// HasSecrets tells if there is any Secret that has to be delivered.
+func (s *manifestSet) HasSecrets() bool {
+	return len(s.Secrets) > 0
+}
+
+// AddResource adds a file to the set and lists it in the kustomization.
+func (s *manifestSet) AddResource(name, content string) {
+	s.Files[name] = content
+	s.Resources = append(s.Resources, name)
+	sort.Strings(s.Resources)
+}
+
+// AddGenerator adds a file to the set and lists it as a kustomize generator.
+func (s *manifestSet) AddGenerator(name, content string) {
+	s.Files[name] = content
+	s.Generators = append(s.Generators, name)
+	sort.Strings(s.Generators)
+}
+
+// Kustomize writes the `kustomization.yaml` that ArgoCD builds, with the
+// resources and generators added so far.
+func (s *manifestSet) Kustomize() {
+	s.Files[kustomizationFile] = kustomization(s.Resources, s.Generators)
+}
+
+// parseManifests reads a multi-document YAML stream and returns the objects
+// found in it. Empty documents, such as the ones helm leaves with only the
+// `# Source:` comment, are skipped.
+func parseManifests(data string) ([]manifest, error) {
+	var manifests []manifest
+
+	dec := yaml.NewDecoder(strings.NewReader(data))
+	for {
+		var doc yaml.Node
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing manifests: %w", err)
+		}
+
+		if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+			continue
+		}
+
+		var meta manifestMeta
+		if err := doc.Decode(&meta); err != nil {
+			return nil, fmt.Errorf("parsing manifest metadata: %w", err)
+		}
+
+		if meta.Kind == "" {
+			return nil, fmt.Errorf("manifest at line %d has no kind", doc.Line)
+		}
+
+		manifests = append(manifests, manifest{
+			Kind:        meta.Kind,
+			Name:        meta.Metadata.Name,
+			Namespace:   meta.Metadata.Namespace,
+			Component:   componentOf(meta.Metadata.Labels),
+			Annotations: meta.Metadata.Annotations,
+			doc:         &doc,
+		})
+	}
+
+	return manifests, nil
+}
+
+func componentOf(labels map[string]string) string {
+	for _, label := range componentLabels {
+		if value := labels[label]; value != "" {
+			return value
+		}
+	}
+
+	return "common"
+}
+
+// isHelmTest tells if the object is a helm test hook, which must not be
+// deployed by ArgoCD.
+func (m manifest) isHelmTest() bool {
+	hooks, ok := m.Annotations["helm.sh/hook"]
+	if !ok {
+		return false
+	}
+
+	for hook := range strings.SplitSeq(hooks, ",") {
+		if strings.HasPrefix(strings.TrimSpace(hook), "test") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m manifest) isSecret() bool {
+	return m.Kind == "Secret"
+}
+
+// sortManifests orders the objects by kind, namespace and name, so that the
+// generated files do not change when helmfile renders the releases in a
+// different order.
+func sortManifests(manifests []manifest) {
+	sort.SliceStable(manifests, func(i, j int) bool {
+		a, b := manifests[i], manifests[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+}
+
+// encodeManifests writes the objects as a multi-document YAML stream.
+func encodeManifests(manifests []manifest) (string, error) {
+	var buf bytes.Buffer
+
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	for _, m := range manifests {
+		if err := enc.Encode(m.doc); err != nil {
+			return "", fmt.Errorf("encoding %s %q: %w", m.Kind, m.Name, err)
+		}
+	}
+
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// splitManifests separates the Secrets from the rest of the rendered objects,
+// dropping the helm test hooks, and lays the non-secret objects out in files
+// following the given layout. The Secrets are left to the secret backend.
+func splitManifests(data string, layout Layout) (*manifestSet, error) {
+	manifests, err := parseManifests(data)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &manifestSet{Files: map[string]string{}}
+	groups := map[string][]manifest{}
+
+	for _, m := range manifests {
+		if m.isHelmTest() {
+			continue
+		}
+
+		if m.isSecret() {
+			set.Secrets = append(set.Secrets, m)
+			continue
+		}
+
+		file, err := layoutFile(m, layout)
+		if err != nil {
+			return nil, err
+		}
+		groups[file] = append(groups[file], m)
+	}
+
+	for file, group := range groups {
+		sortManifests(group)
+		content, err := encodeManifests(group)
+		if err != nil {
+			return nil, err
+		}
+
+		set.AddResource(file, content)
+	}
+
+	sortManifests(set.Secrets)
+
+	return set, nil
+}
+
+func layoutFile(m manifest, layout Layout) (string, error) {
+	switch layout {
+	case FLAT, "":
+		return nonSecretsFile, nil
+	case KIND:
+		return path.Join(resourcesDir, fileName(m.Kind)), nil
+	case COMPONENT:
+		return path.Join(resourcesDir, fileName(m.Component)), nil
+	default:
+		return "", fmt.Errorf("unknown layout %q", layout)
+	}
+}
+
+func fileName(s string) string {
+	s = strings.ToLower(s)
+	s = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, s)
+
+	return s + ".yaml"
+}
+
+func marshalYaml(v any) string {
+	var buf bytes.Buffer
+
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	// Only plain maps and slices are marshalled, so it cannot fail.
+	_ = enc.Encode(v)
+	_ = enc.Close()
+
+	return buf.String()
+}
+
+// kustomization returns the `kustomization.yaml` that ArgoCD builds.
+func kustomization(resources, generators []string) string {
+	k := struct {
+		ApiVersion string   `yaml:"apiVersion"`
+		Kind       string   `yaml:"kind"`
+		Resources  []string `yaml:"resources,omitempty"`
+		Generators []string `yaml:"generators,omitempty"`
+	}{
+		ApiVersion: "kustomize.config.k8s.io/v1beta1",
+		Kind:       "Kustomization",
+		Resources:  resources,
+		Generators: generators,
+	}
+
+	return marshalYaml(k)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"dagger/cd/internal/telemetry"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The name the spans and the metrics of the stages are reported with.
+const instrumentation = "zoo/cd"
+
+// The attributes of the stages. Only the environment and the package are set in
+// the metrics, since the digests change on every run.
+const (
+	envAttr     = attribute.Key("zoo.env")
+	packageAttr = attribute.Key("zoo.package")
+	digestAttr  = attribute.Key("zoo.digest")
+	stageAttr   = attribute.Key("zoo.stage")
+	outcomeAttr = attribute.Key("zoo.outcome")
+)
+
+// stage runs a stage of the deployment, such as "template" or "encrypt", in its
+// own span, and records how long it took and whether it failed in the
+// "zoo.stage.duration" and "zoo.stage.runs" metrics. Dagger exports both
+// through OTLP, along with the rest of its telemetry, to the endpoint in
+// `OTEL_EXPORTER_OTLP_ENDPOINT`. The stage must evaluate its containers, or the
+// span would end before they run.
+func stage(ctx context.Context, name string, attrs []attribute.KeyValue, fn func(context.Context) error) (rerr error) {
+	ctx, span := telemetry.Tracer(ctx, instrumentation).Start(ctx, name, trace.WithAttributes(attrs...))
+	defer telemetry.End(span, func() error { return rerr })
+
+	start := time.Now()
+	defer func() {
+		recordStage(ctx, name, attrs, time.Since(start), rerr)
+	}()
+
+	return fn(ctx)
+}
+
+// setDigest adds the digest of what the current stage produced to its span.
+func setDigest(ctx context.Context, digest string) {
+	trace.SpanFromContext(ctx).SetAttributes(digestAttr.String(digest))
+}
+
+func recordStage(ctx context.Context, name string, attrs []attribute.KeyValue, elapsed time.Duration, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+
+	labels := []attribute.KeyValue{stageAttr.String(name), outcomeAttr.String(outcome)}
+	for _, attr := range attrs {
+		if attr.Key == envAttr || attr.Key == packageAttr {
+			labels = append(labels, attr)
+		}
+	}
+	set := metric.WithAttributes(labels...)
+
+	meter := telemetry.Meter(ctx, instrumentation)
+
+	duration, err := meter.Float64Histogram(
+		"zoo.stage.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of the stages of the pipeline."),
+	)
+	if err == nil {
+		duration.Record(ctx, elapsed.Seconds(), set)
+	}
+
+	runs, err := meter.Int64Counter(
+		"zoo.stage.runs",
+		metric.WithDescription("Runs of the stages of the pipeline, by outcome."),
+	)
+	if err == nil {
+		runs.Add(ctx, 1, set)
+	}
+
+	// The module exits without shutting its meter provider down, so the metrics
+	// are sent before that.
+	_ = telemetry.MeterProvider(ctx).ForceFlush(ctx)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"dagger/cd/internal/dagger"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Generates a new AGE key pair and rotates the secrets of the deploy branch to
+// it. The secrets files of the environments are re-encrypted for the new
+// recipients with `sops updatekeys`, the `.sops.yaml` is updated and the
+// `sops-age` secret that ArgoCD uses in the cluster is replaced. Before the
+// cluster is touched every file is decrypted with only the new key, and before
+// anything is pushed the environments are rendered by the ArgoCD repo server
+// with the keys of the cluster. It returns a directory with the new private key
+// and the new `.sops.yaml`.
+func (m *Cd) RotateKeys(
+	ctx context.Context,
+
+	// `.env` file with the `STATE_REPO` token to push to the state repository.
+	// +required
+	secEnv *dagger.Secret,
+
+	// Current AGE private key file, able to decrypt the secrets.
+	// +required
+	ageKey *dagger.File,
+
+	// Environments whose secrets are rotated. Defaults to all of them.
+	// +optional
+	envs []Envs,
+
+	// AGE public keys that can also decrypt the secrets, apart from the new one.
+	// +optional
+	recipients []string,
+
+	// Keep the current key in the `sops-age` secret of the cluster, along with
+	// the new one. It is needed when only some environments are rotated, as
+	// the rest are still encrypted for the current key alone.
+	// +optional
+	keepOldKey bool,
+) (*dagger.Directory, error) {
+	if len(envs) == 0 {
+		envs = allEnvs
+	}
+
+	if !keepOldKey && isPartial(envs) {
+		return nil, fmt.Errorf("rotating only %s would leave the other environments without a key in the cluster, keep the old key", joinEnvs(envs, ", "))
+	}
+
+	ctr := m.Cluster(ctx).
+		WithExec([]string{"apk", "add", "--no-cache", "git"}).
+		// A new key must be generated, and the branch cloned, on every call.
+		WithEnvVariable("ROTATED_AT", time.Now().Format(time.RFC3339Nano))
+
+	ctr, err := setEnvVariables(ctx, ctr, secEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	ctr = withAgeKey(withDeployBranch(ctr), ageKey).
+		WithExec([]string{"mkdir", "-p", "/keys"}).
+		WithExec([]string{"age-keygen", "-o", "/keys/age.agekey"})
+
+	newRecipients, err := publicKeys(ctx, ctr, "/keys/age.agekey")
+	if err != nil {
+		return nil, err
+	}
+	newRecipients = append(newRecipients, recipients...)
+
+	sopsYaml, err := ctr.
+		WithExec([]string{"sh", "-c", "cat /deploy/.sops.yaml 2>/dev/null || true"}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, env := range envs {
+		encryptedRegex := defaultEncryptedRegex
+
+		rule, err := findSopsRule(sopsYaml, env)
+		if err != nil {
+			return nil, err
+		}
+		if rule != nil && rule.EncryptedRegex != "" {
+			encryptedRegex = rule.EncryptedRegex
+		}
+
+		sopsYaml, err = upsertSopsRule(sopsYaml, env, newRecipients, encryptedRegex)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, fmt.Sprintf("%s/%s", env, secretsFile))
+	}
+
+	updateScript := fmt.Sprintf(`
+		set -euxo pipefail
+
+		for file in %s; do
+			if [ -f "$file" ]; then
+				echo "--- Updating the keys of '$file' ---"
+				sops updatekeys --yes "$file"
+			fi
+		done
+
+		echo "--- Checking that the new key alone decrypts the secrets ---"
+		for file in %s; do
+			if [ -f "$file" ]; then
+				XDG_CONFIG_HOME=/nonexistent SOPS_AGE_KEY_FILE=/keys/age.agekey \
+					sops --decrypt "$file" > /dev/null
+			fi
+		done
+
+		echo "--- Storing the old and the new keys in the cluster ---"
+		cat /keys/age.agekey %s > /keys/cluster.agekey
+		kubectl create secret generic sops-age -n argocd \
+			--from-file=keys.txt=/keys/cluster.agekey \
+			--dry-run=client -o yaml | kubectl apply -f -
+	`, strings.Join(files, " "), strings.Join(files, " "), ageKeyPath)
+
+	ctr = ctr.
+		WithNewFile("/deploy/.sops.yaml", sopsYaml).
+		WithWorkdir("/deploy").
+		WithExec([]string{"sh", "-c", updateScript})
+
+	ctr = withRepoServerCheck(ctr)
+
+	ctr = ctr.WithExec([]string{"sh", "-c", fmt.Sprintf(`
+		set -euxo pipefail
+
+		git add .
+		if git diff --staged --quiet; then
+			echo "No changes to commit."
+		else
+			git commit -m "Rotate the AGE keys of %s"
+			git push origin deploy
+		fi
+	`, joinEnvs(envs, ", "))})
+
+	if !keepOldKey {
+		ctr = ctr.WithExec([]string{"sh", "-c", `
+			set -euxo pipefail
+
+			echo "--- Removing the old key from the cluster ---"
+			kubectl create secret generic sops-age -n argocd \
+				--from-file=keys.txt=/keys/age.agekey \
+				--dry-run=client -o yaml | kubectl apply -f -
+		`})
+
+		ctr = withRepoServerCheck(ctr)
+	}
+
+	ctr, err = ctr.Sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := dag.Directory().
+		WithFile("age.agekey", ctr.File("/keys/age.agekey")).
+		WithFile(".sops.yaml", ctr.File("/deploy/.sops.yaml"))
+
+	return keys, nil
+}
+
+// withRepoServerCheck restarts the ArgoCD repo server, so that it reads the
+// `sops-age` secret again, waits for it and renders every environment of the
+// deploy branch in it. KSOPS decrypts the secrets there with the keys of the
+// cluster, so it fails if ArgoCD could not.
+func withRepoServerCheck(ctr *dagger.Container) *dagger.Container {
+	return ctr.
+		WithExec([]string{"kubectl", "rollout", "restart", "deployment", "argocd-repo-server", "-n", "argocd"}).
+		WithExec([]string{"kubectl", "rollout", "status", "deployment", "argocd-repo-server", "-n", "argocd", "--timeout=5m"}).
+		WithExec([]string{"sh", "-c", fmt.Sprintf(`
+			set -euxo pipefail
+
+			for env in %s; do
+				if [ -f "$env/%s" ]; then
+					echo "--- Rendering '$env' in the ArgoCD repo server ---"
+					tar -cf - "$env" | kubectl exec -i -n argocd deployment/argocd-repo-server -c repo-server -- sh -c "
+						set -e
+						dir=\$(mktemp -d)
+						tar -xf - -C \$dir
+						kustomize build --enable-alpha-plugins --enable-exec \$dir/$env > /dev/null
+						rm -rf \$dir
+					"
+				fi
+			done
+		`, joinEnvs(allEnvs, " "), kustomizationFile)})
+}
+
+// isPartial tells if some environment is left out of the rotation.
+func isPartial(envs []Envs) bool {
+	for _, env := range allEnvs {
+		if !slices.Contains(envs, env) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func joinEnvs(envs []Envs, sep string) string {
+	names := make([]string, len(envs))
+	for i, env := range envs {
+		names[i] = string(env)
+	}
+
+	return strings.Join(names, sep)
+}
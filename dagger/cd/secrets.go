@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"dagger/cd/internal/dagger"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type SecretBackend string
+
+const (
+	// The Secrets are encrypted with sops and decrypted by KSOPS in ArgoCD.
+	KSOPS SecretBackend = "ksops"
+	// The Secrets are sealed with the public certificate of the Sealed Secrets
+	// controller of the cluster.
+	SEALED SecretBackend = "sealed"
+	// The Secrets are replaced by ExternalSecrets that read the values from a
+	// store of the External Secrets Operator.
+	EXTERNAL SecretBackend = "external"
+)
+
+const (
+	sealedSecretsFile   = "sealed-secrets.yaml"
+	externalSecretsFile = "external-secrets.yaml"
+)
+
+// Annotation of the SealedSecrets with the HMAC of the Secret, the namespace
+// and the certificate they were sealed from. It is keyed with the `.env`, which
+// never reaches the state repository, so the plaintext cannot be guessed from
+// it.
+const sealedHashAnnotation = "zoo.vieites-tfg/sealed-from-hmac"
+
+// backendOf returns the secret backend of the environment, given as
+// "env=backend" entries, or the default one when it is not listed.
+func backendOf(env Envs, def SecretBackend, backends []string) (SecretBackend, error) {
+	backend := def
+
+	for _, entry := range backends {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return "", fmt.Errorf("the secret backend %q is not env=backend", entry)
+		}
+
+		switch b := SecretBackend(strings.TrimSpace(value)); b {
+		case KSOPS, SEALED, EXTERNAL:
+			if Envs(strings.TrimSpace(name)) == env {
+				backend = b
+			}
+		default:
+			return "", fmt.Errorf("unknown secret backend %q for %s", value, name)
+		}
+	}
+
+	return backend, nil
+}
+
+// secretManifest is the part of a Secret needed to replace it by another object.
+type secretManifest struct {
+	Type     string `yaml:"type"`
+	Metadata struct {
+		Name        string            `yaml:"name"`
+		Namespace   string            `yaml:"namespace"`
+		Labels      map[string]string `yaml:"labels"`
+		Annotations map[string]string `yaml:"annotations"`
+	} `yaml:"metadata"`
+	Data       map[string]string `yaml:"data"`
+	StringData map[string]string `yaml:"stringData"`
+}
+
+// keys returns the keys of the Secret, in order.
+func (s secretManifest) keys() []string {
+	var keys []string
+	for key := range s.Data {
+		keys = append(keys, key)
+	}
+	for key := range s.StringData {
+		if _, ok := s.Data[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// withKsops adds the Secrets, still in plain text, and the KSOPS generator
+// that decrypts them once they are encrypted.
+func withKsops(set *manifestSet) error {
+	content, err := encodeManifests(set.Secrets)
+	if err != nil {
+		return err
+	}
+
+	set.Files[secretsFile] = content
+	set.AddGenerator(secretGeneratorFile, ksopsGenerator([]string{secretsFile}))
+
+	return nil
+}
+
+// ksopsGenerator returns the KSOPS generator that decrypts the given files.
+func ksopsGenerator(files []string) string {
+	type metadata struct {
+		Name        string            `yaml:"name"`
+		Annotations map[string]string `yaml:"annotations"`
+	}
+
+	g := struct {
+		ApiVersion string   `yaml:"apiVersion"`
+		Kind       string   `yaml:"kind"`
+		Metadata   metadata `yaml:"metadata"`
+		Files      []string `yaml:"files"`
+	}{
+		ApiVersion: "viaduct.ai/v1",
+		Kind:       "ksops",
+		Metadata: metadata{
+			Name: "secret-generator",
+			Annotations: map[string]string{
+				"config.kubernetes.io/function": "exec:\n  path: ksops\n",
+			},
+		},
+		Files: files,
+	}
+
+	return marshalYaml(g)
+}
+
+// withExternalSecrets replaces every Secret by an ExternalSecret that creates
+// it from the given store. Each key of the Secret is read from the property
+// with the same name of the remote key `<env>/<secret name>`, so the values
+// never reach the state repository.
+func withExternalSecrets(set *manifestSet, env Envs, store string, storeKind string) error {
+	if store == "" {
+		return fmt.Errorf("a secret store is needed to use external secrets")
+	}
+
+	type remoteRef struct {
+		Key      string `yaml:"key"`
+		Property string `yaml:"property"`
+	}
+	type data struct {
+		SecretKey string    `yaml:"secretKey"`
+		RemoteRef remoteRef `yaml:"remoteRef"`
+	}
+
+	var externalSecrets []any
+	for _, m := range set.Secrets {
+		var secret secretManifest
+		if err := m.doc.Decode(&secret); err != nil {
+			return fmt.Errorf("parsing secret %q: %w", m.Name, err)
+		}
+
+		var refs []data
+		for _, key := range secret.keys() {
+			refs = append(refs, data{
+				SecretKey: key,
+				RemoteRef: remoteRef{
+					Key:      fmt.Sprintf("%s/%s", env, m.Name),
+					Property: key,
+				},
+			})
+		}
+
+		templateMetadata := map[string]any{}
+		if len(secret.Metadata.Labels) > 0 {
+			templateMetadata["labels"] = secret.Metadata.Labels
+		}
+		if len(secret.Metadata.Annotations) > 0 {
+			templateMetadata["annotations"] = secret.Metadata.Annotations
+		}
+
+		template := map[string]any{}
+		if secret.Type != "" {
+			template["type"] = secret.Type
+		}
+		if len(templateMetadata) > 0 {
+			template["metadata"] = templateMetadata
+		}
+
+		target := map[string]any{
+			"name":           m.Name,
+			"creationPolicy": "Owner",
+		}
+		if len(template) > 0 {
+			target["template"] = template
+		}
+
+		metadata := map[string]any{"name": m.Name}
+		if m.Namespace != "" {
+			metadata["namespace"] = m.Namespace
+		}
+
+		externalSecrets = append(externalSecrets, map[string]any{
+			"apiVersion": "external-secrets.io/v1beta1",
+			"kind":       "ExternalSecret",
+			"metadata":   metadata,
+			"spec": map[string]any{
+				"refreshInterval": "1h",
+				"secretStoreRef": map[string]string{
+					"name": store,
+					"kind": storeKind,
+				},
+				"target": target,
+				"data":   refs,
+			},
+		})
+	}
+
+	var docs []string
+	for _, es := range externalSecrets {
+		docs = append(docs, marshalYaml(es))
+	}
+
+	set.AddResource(externalSecretsFile, strings.Join(docs, "---\n"))
+
+	return nil
+}
+
+// withSealedSecrets seals every Secret with `kubeseal` and the given public
+// certificate of the controller. Secrets without namespace are sealed for the
+// namespace of the environment, the one ArgoCD deploys to. Sealing is
+// randomized, so the SealedSecrets of the deploy branch, cloned in `/deploy`,
+// are kept when they were sealed from the same Secret with the same
+// certificate, and there is nothing to commit. They are matched by an HMAC
+// keyed with the `.env`.
+func withSealedSecrets(
+	ctx context.Context,
+	ctr *dagger.Container,
+	set *manifestSet,
+	env Envs,
+	cert *dagger.File,
+	secEnv *dagger.Secret,
+) error {
+	ctr = ctr.WithFile("/app/sealed-secrets.pem", cert)
+
+	key, err := secEnv.Plaintext(ctx)
+	if err != nil {
+		return fmt.Errorf("reading the key of the sealed secrets: %w", err)
+	}
+
+	pem, err := cert.Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("reading the sealing certificate: %w", err)
+	}
+
+	previous, err := ctr.
+		WithExec([]string{"sh", "-c", fmt.Sprintf("cat /deploy/%s/%s 2>/dev/null || true", env, sealedSecretsFile)}).
+		Stdout(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The previous file is only an optimization, if it cannot be read the
+	// Secrets are sealed again.
+	byHash, err := sealedByHash(previous)
+	if err != nil {
+		byHash = map[string]string{}
+	}
+
+	var sealed []string
+	for _, m := range set.Secrets {
+		secret, err := encodeManifests([]manifest{m})
+		if err != nil {
+			return err
+		}
+
+		namespace := m.Namespace
+		if namespace == "" {
+			namespace = string(env)
+		}
+
+		hash := sealedHash([]byte(key), pem, namespace, secret)
+		if kept, ok := byHash[hash]; ok {
+			sealed = append(sealed, kept)
+			continue
+		}
+
+		out, err := ctr.
+			WithExec(
+				[]string{"kubeseal", "--format", "yaml", "--cert", "/app/sealed-secrets.pem", "--namespace", namespace},
+				dagger.ContainerWithExecOpts{Stdin: secret},
+			).
+			Stdout(ctx)
+		if err != nil {
+			return fmt.Errorf("sealing secret %q: %w", m.Name, err)
+		}
+
+		out, err = withSealedHash(out, hash)
+		if err != nil {
+			return fmt.Errorf("sealing secret %q: %w", m.Name, err)
+		}
+
+		sealed = append(sealed, out)
+	}
+
+	set.AddResource(sealedSecretsFile, strings.Join(sealed, "---\n"))
+
+	return nil
+}
+
+// sealedHash returns the HMAC, with the given key, of a Secret sealed for the
+// namespace with the given certificate.
+func sealedHash(key []byte, cert, namespace, secret string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(cert + "\n" + namespace + "\n" + secret))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// withSealedHash annotates a SealedSecret with the HMAC of the Secret it was
+// sealed from.
+func withSealedHash(sealed string, hash string) (string, error) {
+	var obj map[string]any
+	if err := yaml.Unmarshal([]byte(sealed), &obj); err != nil {
+		return "", fmt.Errorf("parsing sealed secret: %w", err)
+	}
+
+	metadata, _ := obj["metadata"].(map[string]any)
+	if metadata == nil {
+		metadata = map[string]any{}
+		obj["metadata"] = metadata
+	}
+
+	annotations, _ := metadata["annotations"].(map[string]any)
+	if annotations == nil {
+		annotations = map[string]any{}
+		metadata["annotations"] = annotations
+	}
+	annotations[sealedHashAnnotation] = hash
+
+	return marshalYaml(obj), nil
+}
+
+// sealedByHash returns the SealedSecrets of a previous deploy by the HMAC of
+// the Secret they were sealed from. The ones without the annotation are left
+// out, so they are sealed again.
+func sealedByHash(previous string) (map[string]string, error) {
+	manifests, err := parseManifests(previous)
+	if err != nil {
+		return nil, err
+	}
+
+	byHash := map[string]string{}
+	for _, m := range manifests {
+		hash := m.Annotations[sealedHashAnnotation]
+		if m.Kind != "SealedSecret" || hash == "" {
+			continue
+		}
+
+		var obj map[string]any
+		if err := m.doc.Decode(&obj); err != nil {
+			return nil, fmt.Errorf("parsing sealed secret %q: %w", m.Name, err)
+		}
+
+		byHash[hash] = marshalYaml(obj)
+	}
+
+	return byHash, nil
+}
+
+// sealingCertOf fetches the public certificate of the Sealed Secrets controller
+// of the cluster.
+func sealingCertOf(ctr *dagger.Container) *dagger.File {
+	return ctr.
+		WithExec([]string{"sh", "-c", "kubeseal --fetch-cert > /app/sealed-secrets.pem"}).
+		File("/app/sealed-secrets.pem")
+}
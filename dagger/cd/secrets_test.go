@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestBackendOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      Envs
+		backends []string
+		want     SecretBackend
+		wantErr  bool
+	}{
+		{
+			name: "no mapping",
+			env:  DEV,
+			want: KSOPS,
+		},
+		{
+			name:     "listed",
+			env:      PRO,
+			backends: []string{"dev=sealed", "pro=external"},
+			want:     EXTERNAL,
+		},
+		{
+			name:     "not listed",
+			env:      PRE,
+			backends: []string{"pro=external"},
+			want:     KSOPS,
+		},
+		{
+			name:     "spaces",
+			env:      DEV,
+			backends: []string{" dev = sealed "},
+			want:     SEALED,
+		},
+		{
+			name:     "not env=backend",
+			env:      DEV,
+			backends: []string{"sealed"},
+			wantErr:  true,
+		},
+		{
+			name:     "unknown backend of another environment",
+			env:      DEV,
+			backends: []string{"pro=vault"},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := backendOf(tt.env, KSOPS, tt.backends)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("backendOf = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+const sealedSecret = `apiVersion: bitnami.com/v1alpha1
+kind: SealedSecret
+metadata:
+  name: mongo
+  namespace: dev
+spec:
+  encryptedData:
+    password: AgBy3i4OJSWK
+`
+
+// An HMAC as the ones written by withSealedSecrets.
+const sealedTestHash = "5d5b09f6dcb2d53a6fffc60670ab456e3b3ba3c6ec1d7b6c7f6b6b7a6c4e2f10"
+
+func TestSealedByHash(t *testing.T) {
+	annotated, err := withSealedHash(sealedSecret, sealedTestHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := strings.ReplaceAll(sealedSecret, "mongo", "backend")
+
+	// The SealedSecrets annotated with a plain digest of the Secret, before it was keyed, are sealed again.
+	digest := strings.Replace(sealedSecret, "  name: mongo\n", "  name: frontend\n  annotations:\n    zoo.vieites-tfg/sealed-from: abc\n", 1)
+
+	byHash, err := sealedByHash(annotated + "---\n" + other + "---\n" + digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(byHash) != 1 {
+		t.Fatalf("sealedByHash = %v, want only the annotated secret", byHash)
+	}
+
+	// The kept SealedSecret is written as it was, so there is nothing to commit.
+	if byHash[sealedTestHash] != annotated {
+		t.Errorf("sealedByHash[%s] = %q, want %q", sealedTestHash, byHash[sealedTestHash], annotated)
+	}
+
+	if !strings.Contains(annotated, sealedHashAnnotation+": "+sealedTestHash) {
+		t.Errorf("withSealedHash = %q, want the %s annotation", annotated, sealedHashAnnotation)
+	}
+
+	if _, err := sealedByHash("kind: ["); err == nil {
+		t.Error("expected an error for an invalid file")
+	}
+}
+
+func TestSealedHash(t *testing.T) {
+	key := []byte("MONGO_PASSWORD=example")
+	hash := sealedHash(key, "cert", "dev", "secret")
+
+	if sealedHash(key, "cert", "dev", "secret") != hash {
+		t.Error("sealedHash is not stable")
+	}
+
+	// Without the key, the hash cannot be computed from the public certificate and namespace and a guessed Secret.
+	digest := sha256.Sum256([]byte("cert\ndev\nsecret"))
+	if hash == hex.EncodeToString(digest[:]) {
+		t.Error("sealedHash is a plain digest of the secret")
+	}
+
+	for name, other := range map[string]string{
+		"key":         sealedHash([]byte("other"), "cert", "dev", "secret"),
+		"certificate": sealedHash(key, "other", "dev", "secret"),
+		"namespace":   sealedHash(key, "cert", "pre", "secret"),
+		"secret":      sealedHash(key, "cert", "dev", "other"),
+	} {
+		if other == hash {
+			t.Errorf("sealedHash does not change with the %s", name)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"dagger/cd/internal/dagger"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Where sops looks for the AGE private keys.
+const ageKeyPath = "/root/.config/sops/age/keys.txt"
+
+// Only the values of the Secrets are encrypted, so the rest of the object can
+// still be read in the state repository.
+const defaultEncryptedRegex = "^(data|stringData)$"
+
+// sopsConfig is the content of a `.sops.yaml` file.
+type sopsConfig struct {
+	CreationRules []sopsRule `yaml:"creation_rules"`
+
+	Extra map[string]any `yaml:",inline"`
+}
+
+type sopsRule struct {
+	PathRegex      string `yaml:"path_regex,omitempty"`
+	EncryptedRegex string `yaml:"encrypted_regex,omitempty"`
+	Age            string `yaml:"age,omitempty"`
+
+	Extra map[string]any `yaml:",inline"`
+}
+
+// sopsMetadata is the part of the `sops` key of an encrypted file that tells
+// how it was encrypted.
+type sopsMetadata struct {
+	Age []struct {
+		Recipient string `yaml:"recipient"`
+	} `yaml:"age"`
+	EncryptedRegex string `yaml:"encrypted_regex"`
+}
+
+// secretsPathRegex matches the secrets file of the environment, whether sops
+// is given a relative or an absolute path.
+func secretsPathRegex(env Envs) string {
+	return fmt.Sprintf("(^|/)%s/%s$", regexp.QuoteMeta(string(env)), regexp.QuoteMeta(secretsFile))
+}
+
+// findSopsRule returns the creation rule of the environment, if there is one.
+func findSopsRule(current string, env Envs) (*sopsRule, error) {
+	var config sopsConfig
+	if err := yaml.Unmarshal([]byte(current), &config); err != nil {
+		return nil, fmt.Errorf("parsing .sops.yaml: %w", err)
+	}
+
+	for _, rule := range config.CreationRules {
+		if rule.PathRegex == secretsPathRegex(env) {
+			return &rule, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// upsertSopsRule returns the `.sops.yaml` content with the creation rule of the
+// environment set to the given recipients and regex, placed before any rule
+// that would otherwise win for its secrets file. The rules of the other
+// environments are kept as they are.
+func upsertSopsRule(current string, env Envs, recipients []string, encryptedRegex string) (string, error) {
+	var config sopsConfig
+	if err := yaml.Unmarshal([]byte(current), &config); err != nil {
+		return "", fmt.Errorf("parsing .sops.yaml: %w", err)
+	}
+
+	rule := sopsRule{
+		PathRegex:      secretsPathRegex(env),
+		EncryptedRegex: encryptedRegex,
+		Age:            strings.Join(recipients, ","),
+	}
+
+	rules := config.CreationRules
+
+	i := slices.IndexFunc(rules, func(r sopsRule) bool {
+		return r.PathRegex == rule.PathRegex
+	})
+	if i >= 0 {
+		rule.Extra = rules[i].Extra
+		rules = slices.Delete(rules, i, i+1)
+	} else {
+		i = len(rules)
+	}
+
+	// sops uses the first rule that matches, so the rule goes ahead of any
+	// broader one that would also match the secrets file, such as a catch-all.
+	file := fmt.Sprintf("%s/%s", env, secretsFile)
+	if j := slices.IndexFunc(rules, func(r sopsRule) bool { return r.covers(file) }); j >= 0 && j < i {
+		i = j
+	}
+
+	config.CreationRules = slices.Insert(rules, i, rule)
+
+	return marshalYaml(config), nil
+}
+
+// covers tells if sops would use the rule for the given file. A rule without
+// a path regex matches every file.
+func (r sopsRule) covers(file string) bool {
+	if r.PathRegex == "" {
+		return true
+	}
+
+	re, err := regexp.Compile(r.PathRegex)
+
+	// A regex Go cannot compile is taken as matching, to stay ahead of it.
+	return err != nil || re.MatchString(file)
+}
+
+// readSopsMetadata returns the sops metadata of an encrypted file. For a
+// multi-document file every document has the same metadata, so the first one
+// is used.
+func readSopsMetadata(encrypted string) (*sopsMetadata, error) {
+	var doc struct {
+		Sops *sopsMetadata `yaml:"sops"`
+	}
+
+	dec := yaml.NewDecoder(strings.NewReader(encrypted))
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("parsing encrypted file: %w", err)
+	}
+
+	if doc.Sops == nil {
+		return nil, fmt.Errorf("the file is not encrypted with sops")
+	}
+
+	return doc.Sops, nil
+}
+
+// matches tells if the file was encrypted for exactly the given recipients and
+// with the given regex.
+func (md *sopsMetadata) matches(recipients []string, encryptedRegex string) bool {
+	if md.EncryptedRegex != encryptedRegex {
+		return false
+	}
+
+	var current []string
+	for _, age := range md.Age {
+		current = append(current, age.Recipient)
+	}
+
+	wanted := slices.Clone(recipients)
+	slices.Sort(current)
+	slices.Sort(wanted)
+
+	return slices.Equal(current, wanted)
+}
+
+// sameManifests tells if both YAML streams hold the same objects, regardless
+// of the formatting and the comments.
+func sameManifests(a, b string) (bool, error) {
+	docsA, err := parseManifests(a)
+	if err != nil {
+		return false, err
+	}
+
+	docsB, err := parseManifests(b)
+	if err != nil {
+		return false, err
+	}
+
+	if len(docsA) != len(docsB) {
+		return false, nil
+	}
+
+	for i := range docsA {
+		var valueA, valueB any
+		if err := docsA[i].doc.Decode(&valueA); err != nil {
+			return false, err
+		}
+		if err := docsB[i].doc.Decode(&valueB); err != nil {
+			return false, err
+		}
+
+		if !reflect.DeepEqual(valueA, valueB) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// parseRecipients splits a list of age recipients that may be separated by
+// commas, spaces or new lines, ignoring the comments of an age key file.
+func parseRecipients(s string) []string {
+	var recipients []string
+	for line := range strings.SplitSeq(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		for _, r := range strings.FieldsFunc(line, func(c rune) bool { return c == ',' || c == ' ' }) {
+			if !slices.Contains(recipients, r) {
+				recipients = append(recipients, r)
+			}
+		}
+	}
+
+	return recipients
+}
+
+// withAgeKey sets the AGE private key sops uses to decrypt.
+func withAgeKey(ctr *dagger.Container, ageKey *dagger.File) *dagger.Container {
+	return ctr.
+		WithExec([]string{"mkdir", "-p", path.Dir(ageKeyPath)}).
+		WithFile(ageKeyPath, ageKey).
+		WithEnvVariable("XDG_CONFIG_HOME", "/root/.config")
+}
+
+// publicKeys returns the AGE public keys of the private keys in the given file.
+func publicKeys(ctx context.Context, ctr *dagger.Container, keyPath string) ([]string, error) {
+	out, err := ctr.
+		WithExec([]string{"age-keygen", "-y", keyPath}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseRecipients(out), nil
+}
+
+// encryptSecrets encrypts the secrets file in `/app/manifests` for the given
+// recipients and updates the rule of the environment in the `.sops.yaml` of the
+// deploy branch, cloned in `/deploy`. When the Secrets did not change since the
+// last deploy and they are encrypted the same way, the previous file is kept so
+// that the ciphertext does not change and there is nothing to commit.
+func encryptSecrets(
+	ctx context.Context,
+	ctr *dagger.Container,
+	set *manifestSet,
+	env Envs,
+	recipients []string,
+	encryptedRegex string,
+) (*dagger.Container, error) {
+	previousPath := fmt.Sprintf("/deploy/%s/%s", env, secretsFile)
+	manifestsPath := "/app/manifests/" + secretsFile
+
+	sopsYaml, err := ctr.
+		WithExec([]string{"sh", "-c", "cat /deploy/.sops.yaml 2>/dev/null || true"}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sopsYaml, err = upsertSopsRule(sopsYaml, env, recipients, encryptedRegex)
+	if err != nil {
+		return nil, err
+	}
+
+	ctr = ctr.WithNewFile("/deploy/.sops.yaml", sopsYaml)
+
+	if unchanged(ctx, ctr, previousPath, set.Files[secretsFile], recipients, encryptedRegex) {
+		return ctr.WithExec([]string{"cp", previousPath, manifestsPath}), nil
+	}
+
+	return ctr.WithExec([]string{
+		"sops", "--encrypt",
+		"--encrypted-regex", encryptedRegex,
+		"--age", strings.Join(recipients, ","),
+		"--in-place", manifestsPath,
+	}), nil
+}
+
+// unchanged tells if the encrypted file in the given path holds the same
+// Secrets, for the same recipients. Any error reading or decrypting it means
+// that it has to be encrypted again.
+func unchanged(
+	ctx context.Context,
+	ctr *dagger.Container,
+	path string,
+	plaintext string,
+	recipients []string,
+	encryptedRegex string,
+) bool {
+	previous, err := ctr.
+		WithExec([]string{"sh", "-c", fmt.Sprintf("cat %s 2>/dev/null || true", path)}).
+		Stdout(ctx)
+	if err != nil || previous == "" {
+		return false
+	}
+
+	md, err := readSopsMetadata(previous)
+	if err != nil || !md.matches(recipients, encryptedRegex) {
+		return false
+	}
+
+	decrypted, err := ctr.
+		WithExec([]string{"sops", "--decrypt", path}).
+		Stdout(ctx)
+	if err != nil {
+		return false
+	}
+
+	same, err := sameManifests(decrypted, plaintext)
+
+	return err == nil && same
+}
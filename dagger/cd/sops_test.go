@@ -0,0 +1,266 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestUpsertSopsRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		env     Envs
+		// The path_regex and age of every rule, in order.
+		rules   [][2]string
+		wantErr bool
+	}{
+		{
+			name:    "no config",
+			current: "",
+			env:     DEV,
+			rules: [][2]string{
+				{secretsPathRegex(DEV), "age1new"},
+			},
+		},
+		{
+			name: "other environment",
+			current: `creation_rules:
+  - path_regex: (^|/)pro/secrets\.yaml$
+    age: age1pro
+`,
+			env: DEV,
+			rules: [][2]string{
+				{secretsPathRegex(PRO), "age1pro"},
+				{secretsPathRegex(DEV), "age1new"},
+			},
+		},
+		{
+			name: "same environment",
+			current: `creation_rules:
+  - path_regex: (^|/)dev/secrets\.yaml$
+    age: age1old
+  - path_regex: (^|/)pro/secrets\.yaml$
+    age: age1pro
+`,
+			env: DEV,
+			rules: [][2]string{
+				{secretsPathRegex(DEV), "age1new"},
+				{secretsPathRegex(PRO), "age1pro"},
+			},
+		},
+		{
+			name: "catch-all rule",
+			current: `creation_rules:
+  - path_regex: (^|/)pro/secrets\.yaml$
+    age: age1pro
+  - path_regex: .*
+    age: age1all
+`,
+			env: DEV,
+			rules: [][2]string{
+				{secretsPathRegex(PRO), "age1pro"},
+				{secretsPathRegex(DEV), "age1new"},
+				{".*", "age1all"},
+			},
+		},
+		{
+			name: "rule without path regex",
+			current: `creation_rules:
+  - age: age1all
+`,
+			env: DEV,
+			rules: [][2]string{
+				{secretsPathRegex(DEV), "age1new"},
+				{"", "age1all"},
+			},
+		},
+		{
+			name: "same environment after a broader rule",
+			current: `creation_rules:
+  - path_regex: secrets\.yaml$
+    age: age1all
+  - path_regex: (^|/)dev/secrets\.yaml$
+    age: age1old
+`,
+			env: DEV,
+			rules: [][2]string{
+				{secretsPathRegex(DEV), "age1new"},
+				{`secrets\.yaml$`, "age1all"},
+			},
+		},
+		{
+			name:    "invalid config",
+			current: "creation_rules: {",
+			env:     DEV,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := upsertSopsRule(tt.current, tt.env, []string{"age1new"}, defaultEncryptedRegex)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var config sopsConfig
+			if err := yaml.Unmarshal([]byte(out), &config); err != nil {
+				t.Fatal(err)
+			}
+
+			var rules [][2]string
+			for _, r := range config.CreationRules {
+				rules = append(rules, [2]string{r.PathRegex, r.Age})
+			}
+			if !slices.Equal(rules, tt.rules) {
+				t.Errorf("rules = %v, want %v", rules, tt.rules)
+			}
+
+			rule, err := findSopsRule(out, tt.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rule == nil || rule.EncryptedRegex != defaultEncryptedRegex {
+				t.Errorf("rule = %+v, want the encrypted regex %q", rule, defaultEncryptedRegex)
+			}
+		})
+	}
+}
+
+func TestUpsertSopsRuleKeepsExtraKeys(t *testing.T) {
+	current := `creation_rules:
+  - path_regex: (^|/)dev/secrets\.yaml$
+    age: age1old
+    mac_only_encrypted: true
+stores:
+  yaml:
+    indent: 2
+`
+
+	out, err := upsertSopsRule(current, DEV, []string{"age1new"}, defaultEncryptedRegex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var config sopsConfig
+	if err := yaml.Unmarshal([]byte(out), &config); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := config.Extra["stores"]; !ok {
+		t.Error("the stores key was dropped")
+	}
+	if config.CreationRules[0].Extra["mac_only_encrypted"] != true {
+		t.Error("the mac_only_encrypted key of the rule was dropped")
+	}
+}
+
+func TestParseRecipients(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{
+			name: "empty",
+			in:   "",
+			want: nil,
+		},
+		{
+			name: "comma separated",
+			in:   "age1a,age1b",
+			want: []string{"age1a", "age1b"},
+		},
+		{
+			name: "spaces and new lines",
+			in:   "age1a age1b\n  age1c\n\n",
+			want: []string{"age1a", "age1b", "age1c"},
+		},
+		{
+			name: "age key file",
+			in:   "# created: 2025-01-01T00:00:00Z\n# public key: age1a\nage1a\n",
+			want: []string{"age1a"},
+		},
+		{
+			name: "duplicates",
+			in:   "age1a, age1b\nage1a",
+			want: []string{"age1a", "age1b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseRecipients(tt.in)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseRecipients(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSameManifests(t *testing.T) {
+	secret := `apiVersion: v1
+kind: Secret
+metadata:
+  name: zoo-dev-backend
+stringData:
+  MONGO_ROOT: root
+`
+
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{
+			name: "identical",
+			a:    secret,
+			b:    secret,
+			want: true,
+		},
+		{
+			name: "formatting and comments",
+			a:    secret,
+			b: `# Source: zoo/charts/zoo-backend/templates/secret.yaml
+kind: Secret
+apiVersion: v1
+metadata: {name: zoo-dev-backend}
+stringData:
+    MONGO_ROOT: "root"
+`,
+			want: true,
+		},
+		{
+			name: "different value",
+			a:    secret,
+			b:    `{apiVersion: v1, kind: Secret, metadata: {name: zoo-dev-backend}, stringData: {MONGO_ROOT: admin}}`,
+			want: false,
+		},
+		{
+			name: "different number of objects",
+			a:    secret,
+			b:    secret + "---\n" + secret,
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sameManifests(tt.a, tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("sameManifests = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"dagger/dagger/internal/dagger"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// Files outside the packages whose changes affect every package.
+var globalFiles = []string{"package.json", "yarn.lock", "lerna.json", "mongo-init/"}
+
+// workspacePackage is the part of a 'package.json' needed to build the graph of the workspace.
+type workspacePackage struct {
+	Name            string            `json:"name"`
+	Dependencies    map[string]string `json:"dependencies"`
+	DevDependencies map[string]string `json:"devDependencies"`
+}
+
+// Returns the packages, by their directory name, changed between two commits, along with the packages of the workspace that depend on them. Changing a root manifest, the lockfile or the database fixtures affects every package. When there is no base commit, as in the first push of a branch, every package is affected.
+func (m *Ci) Affected(
+	ctx context.Context,
+	// +defaultPath="/"
+	src *dagger.Directory,
+	// Commit the changes are compared with.
+	// +default="origin/main"
+	base string,
+	// Commit with the changes.
+	// +default="HEAD"
+	head string,
+) ([]string, error) {
+	if base == "" {
+		base = "origin/main"
+	}
+	if head == "" {
+		head = "HEAD"
+	}
+
+	packages, err := workspacePackages(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+
+	all := make([]string, 0, len(packages))
+	for dir := range packages {
+		all = append(all, dir)
+	}
+	sort.Strings(all)
+
+	// GitHub sends a zeroed commit as the previous one of a new branch.
+	if strings.Trim(base, "0") == "" {
+		return all, nil
+	}
+
+	out, err := dag.
+		Container().
+		From("node:20").
+		WithMountedDirectory("/repo/.git", src.Directory(".git")).
+		WithWorkdir("/repo").
+		WithExec([]string{"git", "diff", "--name-only", base, head}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := map[string]bool{}
+	for _, file := range strings.Split(strings.TrimSpace(out), "\n") {
+		if file == "" {
+			continue
+		}
+
+		for _, global := range globalFiles {
+			if file == global || strings.HasSuffix(global, "/") && strings.HasPrefix(file, global) {
+				return all, nil
+			}
+		}
+
+		rest, ok := strings.CutPrefix(file, "packages/")
+		if !ok {
+			continue
+		}
+
+		dir, _, _ := strings.Cut(rest, "/")
+		if _, ok := packages[dir]; ok {
+			changed[dir] = true
+		}
+	}
+
+	return withDependents(packages, changed), nil
+}
+
+// workspacePackages returns the packages of the workspace by their directory name.
+func workspacePackages(ctx context.Context, src *dagger.Directory) (map[string]workspacePackage, error) {
+	entries, err := src.Directory("packages").Entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	packages := map[string]workspacePackage{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry, "/") {
+			continue
+		}
+
+		dir := strings.TrimSuffix(entry, "/")
+		content, err := src.File("packages/" + dir + "/package.json").Contents(ctx)
+		if err != nil {
+			continue
+		}
+
+		var pkg workspacePackage
+		err = json.Unmarshal([]byte(content), &pkg)
+		if err != nil {
+			return nil, err
+		}
+
+		packages[dir] = pkg
+	}
+
+	return packages, nil
+}
+
+// withDependents adds to the changed packages the ones that depend on them, directly or not, and returns them sorted.
+func withDependents(packages map[string]workspacePackage, changed map[string]bool) []string {
+	for grown := true; grown; {
+		grown = false
+		for dir, pkg := range packages {
+			if changed[dir] {
+				continue
+			}
+
+			for other := range changed {
+				name := packages[other].Name
+				_, dep := pkg.Dependencies[name]
+				_, devDep := pkg.DevDependencies[name]
+				if dep || devDep {
+					changed[dir] = true
+					grown = true
+					break
+				}
+			}
+		}
+	}
+
+	affected := make([]string, 0, len(changed))
+	for dir := range changed {
+		affected = append(affected, dir)
+	}
+	sort.Strings(affected)
+
+	return affected
+}
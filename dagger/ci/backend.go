@@ -3,8 +3,7 @@ package main
 import (
 	"context"
 	"dagger/dagger/internal/dagger"
-	"fmt"
-	"strconv"
+	"strings"
 )
 
 type Backend struct {
@@ -16,6 +15,12 @@ type Backend struct {
 
 	// The secrets needed to launch the package.
 	Secrets SecMap
+
+	// The database the package connects to.
+	Mongo *Mongo
+
+	// The main object.
+	Ci *Ci
 }
 
 // Builds the backend package, generating only one executable file and returns the container.
@@ -34,6 +39,8 @@ func (m *Backend) Ctr(ctx context.Context) *dagger.Container {
 
 	compiled := build.File("/app/dist/index.js")
 	pkgJson := build.File("/app/packages/backend/package.json")
+	// swagger-jsdoc reads the OpenAPI comments of the routes at runtime.
+	routes := build.Directory("/app/packages/backend/src/routes")
 
 	dag := dagger.Connect()
 	back := dag.
@@ -43,43 +50,52 @@ func (m *Backend) Ctr(ctx context.Context) *dagger.Container {
 		WithWorkdir("/app").
 		WithFile("/app/package.json", pkgJson).
 		WithFile("/app/index.js", compiled).
+		WithDirectory("/app/src/routes", routes).
 		WithExec([]string{"yarn", "install", "--production"}).
 		WithEntrypoint([]string{"node", "index.js"})
 
 	return back
 }
 
-// Creates a Mongo database and, based on the ready-to-run container, binds it to the backend using the environment variable. It returns the backend service with the 3000 port exported.
+// Creates a Mongo database and, based on the ready-to-run container, binds it to the backend using the environment variable. It returns the backend service with the 3000 port exported. The database is seeded with the 'mongo-init' scripts, unless other fixtures are given.
 func (m *Backend) Service(
 	ctx context.Context,
 	// +defaultPath="/"
 	src *dagger.Directory,
+	// +optional
+	fixtures *dagger.Directory,
 ) (*dagger.Service, error) {
-	mongoPort, err := getMongoPort(ctx, m.Secrets.Get("MONGO_PORT"))
+	if fixtures != nil {
+		m.Mongo = m.Mongo.WithFixtures(fixtures)
+	}
+
+	return serveBackend(ctx, m.Ctr(ctx), m.Mongo)
+}
+
+// serveBackend starts the database and the given backend container bound to it.
+func serveBackend(ctx context.Context, ctr *dagger.Container, mongo *Mongo) (*dagger.Service, error) {
+	mongoSvc, err := mongo.Service(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	mongoInit := src.Directory("mongo-init")
-	mongo := dagger.Connect().
-		Container().
-		From("mongo:7.0").
-		WithSecretVariable("MONGO_INITDB_DATABASE", m.Secrets.Get("MONGO_DATABASE")).
-		WithSecretVariable("MONGO_INITDB_ROOT_USERNAME", m.Secrets.Get("MONGO_ROOT")).
-		WithSecretVariable("MONGO_INITDB_ROOT_PASSWORD", m.Secrets.Get("MONGO_ROOT_PASS")).
-		WithExposedPort(mongoPort).
-		WithMountedDirectory("/docker-entrypoint-initdb.d", mongoInit).
-		AsService().
-		WithHostname("mongodb")
+	_, err = mongoSvc.Start(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err = mongo.Start(ctx)
+	mongoUri, err := mongo.Uri(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	mongoUri, err := createMongoUri(ctx, m.Secrets)
+	return bindBackend(ctx, ctr, mongoSvc, mongoUri)
+}
 
-	back := m.Ctr(ctx).
+// bindBackend starts the given backend container bound to a running database.
+func bindBackend(ctx context.Context, ctr *dagger.Container, mongoSvc *dagger.Service, mongoUri *dagger.Secret) (*dagger.Service, error) {
+	back := ctr.
+		WithServiceBinding("mongodb", mongoSvc).
 		WithSecretVariable("MONGODB_URI", mongoUri).
 		AsService().WithHostname("zoo-bakend")
 
@@ -92,104 +108,150 @@ func (m *Backend) Service(
 }
 
 // Run the test for the package.
-func (m *Backend) Test(ctx context.Context) (string, error) {
-	return m.Base.
-		WithExec([]string{"lerna", "run", "test", "--scope", "@vieites-tfg/zoo-backend"}).
-		Stdout(ctx)
+func (m *Backend) Test(ctx context.Context) (*StageResult, error) {
+	return runStage(ctx, "backend unit tests", m.Base, []string{"lerna", "run", "test", "--scope", "@vieites-tfg/zoo-backend"}, "")
 }
 
-// Runs the linter for the package.
-func (m *Backend) Lint(ctx context.Context) (string, error) {
-	return Lint(ctx, m.Base, m.Name)
-}
-
-// Publish the Docker image of the package with the "latest" and the npm package (inside the 'package.json') versions.
-func (m *Backend) PublishImage(ctx context.Context, tag string) (string, error) {
-	var err error
-
-	_, err = m.Lint(ctx)
+// Runs the integration tests of the package against the Mongo database of the backend, with a fresh run for the sources, so that the runs of different sources never share it. It is stopped once the tests finish.
+func (m *Backend) IntegrationTest(
+	ctx context.Context,
+	// +defaultPath="/"
+	src *dagger.Directory,
+) (*StageResult, error) {
+	digest, err := src.Digest(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	_, err = m.Test(ctx)
-	if err != nil {
-		return "", err
+	runId := "integration-" + strings.TrimPrefix(digest, "sha256:")[:16]
+	if m.Mongo.RunId != "" {
+		runId = m.Mongo.RunId + "-" + runId
 	}
+	mongo := m.Mongo.WithRunId(runId)
 
-	return PublishImage(ctx, m.Ctr(ctx), m.Name, m.Secrets.Get("CR_PAT"), tag)
-}
+	svc, err := mongo.Service(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-func getMongoPort(ctx context.Context, port *dagger.Secret) (int, error) {
-	mongo_portStr, err := port.Plaintext(ctx)
+	svc, err = svc.Start(ctx)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	defer svc.Stop(ctx)
 
-	mongo_port, err := strconv.Atoi(mongo_portStr)
+	mongoUri, err := mongo.Uri(ctx)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return mongo_port, nil
+	ctr := m.Base.
+		WithServiceBinding("mongodb", svc).
+		WithSecretVariable("MONGODB_URI", mongoUri)
+
+	return runStage(ctx, "backend integration tests", ctr, []string{"lerna", "run", "test:integration", "--scope", "@vieites-tfg/zoo-backend"}, "")
 }
 
-// Publish the npm package.
-func (m *Backend) PublishPkg(
+// Runs the linter for the package, returning its reports even when it fails. With fix, the fixable problems are fixed and the patched sources of the package are returned.
+func (m *Backend) Lint(
 	ctx context.Context,
-	// +defaultPath="/"
-	src *dagger.Directory,
-) (string, error) {
-	var err error
+	// Fix the fixable problems.
+	// +optional
+	fix bool,
+) (*StageResult, error) {
+	return Lint(ctx, m.Base, m.Name, fix)
+}
 
-	_, err = m.Lint(ctx)
-	if err != nil {
-		return "", err
+// verify runs 'Endtoend' over the sources, unless they are already verified.
+func (m *Backend) verify(ctx context.Context, src *dagger.Directory, token string) error {
+	ok, err := isVerified(ctx, src, token)
+	if err != nil || ok {
+		return err
 	}
 
-	_, err = m.Test(ctx)
-	if err != nil {
-		return "", err
-	}
+	_, err = m.Ci.Verify(ctx, src)
 
-	return PublishPkg(ctx, m.Base, m.Name, m.Secrets.Get("CR_PAT"))
+	return err
 }
 
-func createMongoUri(ctx context.Context, secrets SecMap) (*dagger.Secret, error) {
-	var (
-		err       error
-		root      string
-		rootPass  string
-		mongoPort string
-		db        string
-	)
-
-	root, err = secrets.Get("MONGO_ROOT").Plaintext(ctx)
+// Publish the Docker image of the package with the "latest" and the npm package (inside the 'package.json') versions. Nothing is published when the dependency scan finds violations of the policy, and its result is returned instead.
+func (m *Backend) PublishImage(
+	ctx context.Context,
+	// +defaultPath="/"
+	src *dagger.Directory,
+	tag string,
+	// Token returned by 'verify' for the sources, to skip their verification.
+	// +optional
+	verified string,
+	// Snapshot of the advisory database the dependencies are scanned against. By default, a new one is downloaded.
+	// +optional
+	advisories *dagger.Directory,
+) (*StageResult, error) {
+	err := m.verify(ctx, src, verified)
 	if err != nil {
 		return nil, err
 	}
 
-	rootPass, err = secrets.Get("MONGO_ROOT_PASS").Plaintext(ctx)
+	scan, err := ScanDependencies(ctx, m.Base, src, advisories, m.Name)
 	if err != nil {
 		return nil, err
 	}
 
-	mongoPort, err = secrets.Get("MONGO_PORT").Plaintext(ctx)
+	return m.publishImage(ctx, tag, scan)
+}
+
+// publishImage publishes the Docker image of the verified sources, given the result of the scan of their dependencies,
+// which is returned instead when it failed.
+func (m *Backend) publishImage(ctx context.Context, tag string, scan *StageResult) (*StageResult, error) {
+	if scan.Status == FAILED {
+		return scan, nil
+	}
+
+	return PublishImage(ctx, m.Ctr(ctx), m.Name, m.Secrets.Get("CR_PAT"), tag)
+}
+
+// Publish the npm package, unless its version is already in the registry. Nothing is published when the dependency scan finds violations of the policy, and its result is returned instead.
+func (m *Backend) PublishPkg(
+	ctx context.Context,
+	// +defaultPath="/"
+	src *dagger.Directory,
+	// The dist-tag the version is published with.
+	// +default="latest"
+	distTag string,
+	// Check everything, including the registry, without publishing the package.
+	// +optional
+	dryRun bool,
+	// Publish to a local Verdaccio registry, to try the publication.
+	// +optional
+	local bool,
+	// Token returned by 'verify' for the sources, to skip their verification.
+	// +optional
+	verified string,
+	// Snapshot of the advisory database the dependencies are scanned against. By default, a new one is downloaded.
+	// +optional
+	advisories *dagger.Directory,
+) (*StageResult, error) {
+	err := m.verify(ctx, src, verified)
 	if err != nil {
 		return nil, err
 	}
 
-	db, err = secrets.Get("MONGO_DATABASE").Plaintext(ctx)
+	scan, err := ScanDependencies(ctx, m.Base, src, advisories, m.Name)
 	if err != nil {
 		return nil, err
 	}
+	if scan.Status == FAILED {
+		return scan, nil
+	}
 
-	mongoUri := fmt.Sprintf("mongodb://%s:%s@mongodb:%s/%s?authSource=admin",
-		root,
-		rootPass,
-		mongoPort,
-		db,
-	)
+	return PublishPkg(ctx, m.Base, m.Name, m.Secrets.Get("CR_PAT"), publishOpts{
+		Local:  local,
+		Tag:    distTag,
+		DryRun: dryRun,
+	})
+}
 
-	return dagger.Connect().SetSecret("mongoUri", mongoUri), nil
+// Returns the tarball of the npm package, as it would be published.
+func (m *Backend) Pack(ctx context.Context) (*dagger.File, error) {
+	return PackPkg(ctx, m.Base, m.Name)
 }
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"dagger/dagger/internal/dagger"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type Charts struct {
+	// The source directory, with the charts inside `charts`, one per directory.
+	Src *dagger.Directory
+
+	// The base container from which the functions will be run.
+	Base *dagger.Container
+
+	// The secrets needed to publish the charts.
+	Secrets SecMap
+}
+
+// Returns the names of the charts.
+func (m *Charts) Names(ctx context.Context) ([]string, error) {
+	charts, err := chartsDir(ctx, m.Src)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := charts.Entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry, "/") {
+			names = append(names, strings.TrimSuffix(entry, "/"))
+		}
+	}
+
+	return names, nil
+}
+
+// Returns the version of the chart. A chart named after a package, such as
+// "zoo-backend", takes the version of the package, so that both are released
+// in lockstep. Any other chart, such as the umbrella "zoo", takes the version
+// in 'lerna.json', the one every package is released with, so it fails when
+// lerna versions the packages independently.
+func (m *Charts) Version(ctx context.Context, chart string) (string, error) {
+	pkg, ok := strings.CutPrefix(chart, "zoo-")
+	if ok {
+		entries, err := m.Src.Directory("packages").Entries(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		for _, entry := range entries {
+			if strings.TrimSuffix(entry, "/") == pkg {
+				return PackageVersion(ctx, m.Src, pkg)
+			}
+		}
+	}
+
+	version, err := jsonVersion(ctx, m.Src.File("lerna.json"))
+	if err != nil {
+		return "", err
+	}
+
+	if version == "independent" {
+		return "", fmt.Errorf("the packages are versioned independently, there is no version for the %q chart in 'lerna.json'", chart)
+	}
+
+	return version, nil
+}
+
+// Runs the linter over every chart.
+func (m *Charts) Lint(ctx context.Context) (string, error) {
+	names, err := m.Names(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if len(names) == 0 {
+		return "", nil
+	}
+
+	ctr, err := m.prepared(ctx, names)
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range names {
+		ctr = ctr.WithExec([]string{"helm", "lint", "--strict", name})
+	}
+
+	return ctr.Stdout(ctx)
+}
+
+// Runs the unit tests of every chart, the ones inside its `tests` directory,
+// with the helm-unittest plugin.
+func (m *Charts) Test(ctx context.Context) (string, error) {
+	names, err := m.Names(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if len(names) == 0 {
+		return "", nil
+	}
+
+	ctr, err := m.prepared(ctx, names)
+	if err != nil {
+		return "", err
+	}
+
+	ctr = ctr.
+		WithExec([]string{"helm", "plugin", "install", "https://github.com/helm-unittest/helm-unittest.git", "--version", "v0.5.1"})
+	for _, name := range names {
+		ctr = ctr.WithExec([]string{"helm", "unittest", "--strict", name})
+	}
+
+	return ctr.Stdout(ctx)
+}
+
+// Packages every chart with its version, returning the directory with the
+// packaged charts.
+func (m *Charts) Package(ctx context.Context) (*dagger.Directory, error) {
+	names, err := m.Names(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		return dag.Directory(), nil
+	}
+
+	ctr, err := m.prepared(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		version, err := m.Version(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		ctr = ctr.WithExec([]string{
+			"helm", "package", name,
+			"--version", version,
+			"--app-version", version,
+			"--destination", "/dist",
+		})
+	}
+
+	return ctr.Directory("/dist"), nil
+}
+
+// prepared returns the base container with the version of every chart set in its 'Chart.yaml', and then the dependencies of every chart downloaded, so that the umbrella chart embeds the charts of the packages with their own versions.
+func (m *Charts) prepared(ctx context.Context, names []string) (*dagger.Container, error) {
+	ctr := m.Base
+	for _, name := range names {
+		version, err := m.Version(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		ctr = ctr.WithExec([]string{"sed", "-i", fmt.Sprintf("s/^version:.*/version: %s/", version), name + "/Chart.yaml"})
+	}
+
+	for _, name := range names {
+		ctr = ctr.WithExec([]string{"helm", "dependency", "update", name})
+	}
+
+	return ctr, nil
+}
+
+// Lints, tests, packages and pushes the charts to an OCI registry. When no
+// registry is given, they are pushed to a local `registry:2` service and pulled
+// back, which checks the whole flow without publishing anything. It fails, with
+// exit code 3, if the version of a chart is already in the registry, so that a
+// published chart is never overwritten, unless it is skipped.
+func (m *Charts) Publish(
+	ctx context.Context,
+	// OCI registry to push the charts to, e.g. "oci://ghcr.io/vieites-tfg/charts".
+	// +optional
+	registry string,
+	// Do not fail when the version of a chart is already in the registry, and do not push it.
+	// +optional
+	skipExisting bool,
+) (string, error) {
+	var err error
+
+	_, err = m.Lint(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = m.Test(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	dist, err := m.Package(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	names, err := m.Names(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if len(names) == 0 {
+		return "", nil
+	}
+
+	ctr := m.Base.WithMountedDirectory("/dist", dist)
+	flags := []string{}
+	local := registry == ""
+
+	if local {
+		registry = "oci://registry:5000/charts"
+		flags = append(flags, "--plain-http")
+		ctr = ctr.WithServiceBinding("registry", RegistryService())
+	} else {
+		ctr = ctr.
+			WithSecretVariable("CR_PAT", m.Secrets.Get("CR_PAT")).
+			WithExec([]string{"sh", "-c", fmt.Sprintf(
+				"echo \"$CR_PAT\" | helm registry login %s --username vieitesss --password-stdin",
+				registryHost(registry),
+			)})
+	}
+
+	for _, name := range names {
+		version, err := m.Version(ctx, name)
+		if err != nil {
+			return "", err
+		}
+
+		ctr = ctr.WithExec([]string{"sh", "-c", pushChartScript(registry, name, version, flags, skipExisting)})
+	}
+
+	if local {
+		for _, name := range names {
+			version, err := m.Version(ctx, name)
+			if err != nil {
+				return "", err
+			}
+
+			ctr = ctr.WithExec(append([]string{"helm", "show", "chart", registry + "/" + name, "--version", version}, flags...))
+		}
+	}
+
+	var out string
+
+	err = stage(ctx, "publish", []attribute.KeyValue{packageAttr.String("charts")}, func(ctx context.Context) error {
+		digest, err := dist.Digest(ctx)
+		if err != nil {
+			return err
+		}
+		setDigest(ctx, digest)
+
+		out, err = ctr.Stdout(ctx)
+		return err
+	})
+
+	return out, err
+}
+
+// pushChartScript returns the script that pushes the packaged chart, once it
+// checks that its version is not in the registry yet. Only a chart that is not
+// found is taken as not published, any other error of the registry fails.
+func pushChartScript(registry string, name string, version string, flags []string, skipExisting bool) string {
+	ref := fmt.Sprintf("%s/%s", registry, name)
+	extra := strings.Join(flags, " ")
+
+	return fmt.Sprintf(`
+		set -u
+
+		echo "--- Checking if %[2]s %[3]s is in %[1]s ---"
+		if out=$(helm show chart %[1]s --version %[3]s %[4]s 2>&1); then
+			if [ "%[5]t" = "true" ]; then
+				echo "%[2]s %[3]s is already published in %[1]s, skipping it"
+				exit 0
+			fi
+			echo "%[2]s %[3]s is already published in %[1]s" >&2
+			exit 3
+		fi
+
+		if ! echo "$out" | grep -qi "not found"; then
+			echo "$out" >&2
+			exit 1
+		fi
+
+		set -e
+		echo "--- Pushing %[2]s %[3]s ---"
+		helm push /dist/%[2]s-%[3]s.tgz %[6]s %[4]s
+	`, ref, name, version, extra, skipExisting, registry)
+}
+
+// HelmBase returns a container with Helm and the charts in its working directory.
+func HelmBase(charts *dagger.Directory) *dagger.Container {
+	return dag.
+		Container().
+		From("alpine/helm:3.15.2").
+		WithExec([]string{"apk", "add", "--no-cache", "git"}).
+		WithMountedCache("/root/.cache/helm", dag.CacheVolume("helm-cache")).
+		WithDirectory("/charts", charts).
+		WithWorkdir("/charts")
+}
+
+// chartsDir returns the `charts` directory of the source, failing when there is none, so that the charts are never skipped silently.
+func chartsDir(ctx context.Context, src *dagger.Directory) (*dagger.Directory, error) {
+	entries, err := src.Entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(entries, "charts/") {
+		return nil, fmt.Errorf("there is no `charts` directory in the source")
+	}
+
+	return src.Directory("charts"), nil
+}
+
+// RegistryService returns a local OCI registry, reachable at port 5000.
+func RegistryService() *dagger.Service {
+	return dag.
+		Container().
+		From("registry:2").
+		WithExposedPort(5000).
+		AsService(dagger.ContainerAsServiceOpts{UseEntrypoint: true})
+}
+
+// registryHost returns the host of an OCI reference, e.g. "ghcr.io" for
+// "oci://ghcr.io/vieites-tfg/charts".
+func registryHost(ref string) string {
+	host, _, _ := strings.Cut(strings.TrimPrefix(ref, "oci://"), "/")
+
+	return host
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"dagger/dagger/internal/dagger"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Starts the backend and returns the OpenAPI document it serves at '/api-docs.json'.
+func (m *Backend) OpenApi(
+	ctx context.Context,
+	// +defaultPath="/"
+	src *dagger.Directory,
+) (*dagger.File, error) {
+	back := *m
+	back.Mongo = m.Mongo.WithRunId("openapi")
+
+	svc, err := back.Service(ctx, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer svc.Stop(ctx)
+
+	spec, err := fetchOpenApi(ctx, svc)
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.Directory().WithNewFile("openapi.json", spec).File("openapi.json"), nil
+}
+
+// Runs the contract tests of the backend API. The OpenAPI document of the live service is compared with the previous one, failing on breaking changes such as removed paths or new required fields, and then schemathesis sends requests generated from it to the service, checking that the responses follow the document.
+func (m *Backend) ContractTest(
+	ctx context.Context,
+	// +defaultPath="/"
+	src *dagger.Directory,
+	// OpenAPI document to compare with. Defaults to the one served by the published image with the previous tag.
+	// +optional
+	previous *dagger.File,
+	// Tag of the published image whose OpenAPI document is compared with, when no previous document is given.
+	// +default="latest"
+	previousTag string,
+	// Report the breaking changes without failing.
+	// +optional
+	allowBreaking bool,
+	// Checks run by schemathesis over every response.
+	// +default="not_a_server_error,status_code_conformance,response_schema_conformance"
+	checks string,
+	// Maximum number of requests generated for each operation.
+	// +default=50
+	maxExamples int,
+) (string, error) {
+	if previousTag == "" {
+		previousTag = "latest"
+	}
+	if checks == "" {
+		checks = "not_a_server_error,status_code_conformance,response_schema_conformance"
+	}
+	if maxExamples == 0 {
+		maxExamples = 50
+	}
+
+	var report strings.Builder
+
+	// The requests create and delete animals, so the tests get their own database.
+	back := *m
+	back.Mongo = m.Mongo.WithRunId("contract")
+
+	svc, err := back.Service(ctx, src, nil)
+	if err != nil {
+		return "", err
+	}
+	defer svc.Stop(ctx)
+
+	spec, err := fetchOpenApi(ctx, svc)
+	if err != nil {
+		return "", err
+	}
+
+	// Breaking changes
+	var previousSpec string
+	if previous != nil {
+		previousSpec, err = previous.Contents(ctx)
+	} else {
+		previousSpec, err = m.publishedOpenApi(ctx, previousTag)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if previousSpec == "" {
+		report.WriteString(section("OpenAPI breaking changes", "No previous OpenAPI document to compare with."))
+	} else {
+		changes, err := breakingChanges(previousSpec, spec)
+		if err != nil {
+			return "", err
+		}
+
+		if len(changes) == 0 {
+			report.WriteString(section("OpenAPI breaking changes", "None."))
+		} else {
+			report.WriteString(section("OpenAPI breaking changes", strings.Join(changes, "\n")))
+			if !allowBreaking {
+				return report.String(), fmt.Errorf("the API has %d breaking changes:\n%s", len(changes), strings.Join(changes, "\n"))
+			}
+		}
+	}
+
+	// Schema driven tests
+	out, err := dag.
+		Container().
+		From("schemathesis/schemathesis:v3.39.0").
+		WithServiceBinding("zoo-backend", svc).
+		WithNewFile("/spec/openapi.json", spec).
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{
+			"st", "run", "/spec/openapi.json",
+			"--base-url", "http://zoo-backend:3000",
+			"--checks", checks,
+			"--hypothesis-max-examples", fmt.Sprint(maxExamples),
+			"--hypothesis-derandomize",
+		}).
+		Stdout(ctx)
+	if err != nil {
+		return report.String(), err
+	}
+	report.WriteString(section("Contract tests", out))
+
+	return report.String(), nil
+}
+
+// publishedOpenApi returns the OpenAPI document served by the published image with the given tag, or an empty string if the image does not serve one, as with the images published before the document was served. Any other error, pulling the image or starting it, is returned.
+func (m *Backend) publishedOpenApi(ctx context.Context, tag string) (string, error) {
+	published := dag.
+		Container().
+		WithRegistryAuth("ghcr.io", "vieitesss", m.Secrets.Get("CR_PAT")).
+		From(fmt.Sprintf("ghcr.io/vieites-tfg/zoo-%s:%s", m.Name, tag))
+
+	svc, err := serveBackend(ctx, published, m.Mongo.WithRunId("openapi-"+tag))
+	if err != nil {
+		return "", fmt.Errorf("starting the backend published with the tag %q: %w", tag, err)
+	}
+	defer svc.Stop(ctx)
+
+	spec, err := fetchOpenApi(ctx, svc)
+	if errors.Is(err, errNoOpenApi) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return spec, nil
+}
+
+// errNoOpenApi tells that the backend does not serve an OpenAPI document.
+var errNoOpenApi = errors.New("the backend does not serve '/api-docs.json'")
+
+// fetchOpenApi returns the OpenAPI document served by the running backend, or errNoOpenApi if it answers that there is none.
+func fetchOpenApi(ctx context.Context, svc *dagger.Service) (string, error) {
+	ctr := dag.
+		Container().
+		From("curlimages/curl:8.12.1").
+		WithServiceBinding("zoo-backend", svc).
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{"sh", "-c", `
+			set -eu
+			curl -sS --retry 5 --retry-connrefused -o /tmp/openapi.json -w '%{http_code}' \
+				http://zoo-backend:3000/api-docs.json > /tmp/status
+		`})
+
+	status, err := ctr.File("/tmp/status").Contents(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	switch strings.TrimSpace(status) {
+	case "200":
+		return ctr.File("/tmp/openapi.json").Contents(ctx)
+	case "404":
+		return "", errNoOpenApi
+	default:
+		return "", fmt.Errorf("fetching the OpenAPI document: the backend answered with HTTP %s", strings.TrimSpace(status))
+	}
+}
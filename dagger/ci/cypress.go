@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"dagger/dagger/internal/dagger"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+type Browser string
+
+const (
+	CHROME   Browser = "chrome"
+	FIREFOX  Browser = "firefox"
+	ELECTRON Browser = "electron"
+)
+
+// The specs run by default, relative to the frontend package.
+const defaultSpecs = "cypress/e2e/**/*.cy.ts"
+
+// An exact version, such as "14.1.0", instead of a range.
+var pinnedVersion = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+
+// The options of the Cypress run, shared by 'Frontend.Test' and 'Endtoend'.
+type cypressOpts struct {
+	// Browser in which the specs are run.
+	Browser Browser
+
+	// Glob of the specs to run, relative to the frontend package.
+	Spec string
+
+	// Times a failed test is retried before it is reported as failed.
+	Retries int
+
+	// Number of containers the specs are split across, run in parallel.
+	Shards int
+}
+
+// The sources of the frontend needed to run the specs.
+var cypressSources = []string{"cypress/", "cypress.config.js", "package.json", "tsconfig*.json"}
+
+// Cypress returns the container that runs the e2e specs of the frontend. Its dependencies are installed from the lockfile, so the layer is only rebuilt when a manifest or the lockfile changes, and the Cypress binary is kept in a cache volume between runs. The Cypress version must be pinned in the 'package.json' of the frontend, and it is checked against the installed one.
+func Cypress(ctx context.Context, src *dagger.Directory) (*dagger.Container, error) {
+	version, err := dependencyVersion(ctx, src.File("packages/frontend/package.json"), "cypress")
+	if err != nil {
+		return nil, err
+	}
+
+	if !pinnedVersion.MatchString(version) {
+		return nil, fmt.Errorf("the cypress version of the frontend must be pinned, found %q", version)
+	}
+
+	manifests := dag.
+		Directory().
+		WithDirectory("packages", src.Directory("packages"), dagger.DirectoryWithDirectoryOpts{Include: []string{"*/package.json"}})
+
+	ctr := dag.
+		Container().
+		From("cypress/browsers").
+		WithEnvVariable("YARN_CACHE_FOLDER", "/.yarn/cache").
+		WithMountedCache("/.yarn/cache", dag.CacheVolume("yarn-cache")).
+		WithEnvVariable("CYPRESS_CACHE_FOLDER", "/root/.cache/Cypress").
+		WithMountedCache("/root/.cache/Cypress", dag.CacheVolume(fmt.Sprintf("cypress-%s", version))).
+		WithWorkdir("/e2e").
+		WithFile("package.json", src.File("package.json")).
+		WithFile("yarn.lock", src.File("yarn.lock")).
+		WithDirectory(".", manifests).
+		WithExec([]string{"yarn", "install", "--frozen-lockfile", "--ignore-scripts"}).
+		// The volume may have been emptied since the dependencies were installed, so the binary is checked on every
+		// run. It is only downloaded when it is missing.
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{"npx", "cypress", "install"})
+
+	installed, err := ctr.
+		WithExec([]string{"node", "-p", "require('cypress/package.json').version"}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(installed) != version {
+		return nil, fmt.Errorf("cypress %s is installed, but the frontend needs %s", strings.TrimSpace(installed), version)
+	}
+
+	sources := dag.
+		Directory().
+		WithDirectory(".", src.Directory("packages/frontend"), dagger.DirectoryWithDirectoryOpts{Include: cypressSources})
+
+	return ctr.
+		WithDirectory("packages/frontend", sources).
+		WithWorkdir("/e2e/packages/frontend"), nil
+}
+
+// e2eServices returns the running backend and frontend the e2e specs are run
+// against. The given services are used as they are, and the missing ones are
+// started from the source: the backend on the given database or, when there is
+// none, on a new one seeded with the 'mongo-init' scripts.
+func (m *Ci) e2eServices(
+	ctx context.Context,
+	src *dagger.Directory,
+	mongo *dagger.Service,
+	back *dagger.Service,
+	front *dagger.Service,
+) (*dagger.Service, *dagger.Service, error) {
+	var err error
+
+	if back == nil {
+		backend, err := m.Backend(ctx, src)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if mongo == nil {
+			back, err = backend.Service(ctx, src, nil)
+		} else {
+			var mongoUri *dagger.Secret
+			mongoUri, err = backend.Mongo.Uri(ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			back, err = bindBackend(ctx, backend.Ctr(ctx), mongo, mongoUri)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if front == nil {
+		frontend, err := m.Frontend(ctx, src)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		front = frontend.Service(ctx)
+	}
+
+	front, err = front.Start(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return back, front, nil
+}
+
+// runCypress runs the e2e specs of the frontend against the given services,
+// split across parallel containers, and merges the results of every shard into
+// one, with the screenshots of each shard in its own directory. A failed shard
+// does not stop the others, so the result always has the output of all of them.
+func runCypress(
+	ctx context.Context,
+	src *dagger.Directory,
+	front *dagger.Service,
+	back *dagger.Service,
+	opts cypressOpts,
+) (*StageResult, error) {
+	if opts.Browser == "" {
+		opts.Browser = ELECTRON
+	}
+	if opts.Spec == "" {
+		opts.Spec = defaultSpecs
+	}
+
+	specs, err := src.Directory("packages/frontend").Glob(ctx, opts.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no specs match %q", opts.Spec)
+	}
+
+	cypress, err := Cypress(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+
+	shards := shardSpecs(specs, opts.Shards)
+	results := make([]*StageResult, len(shards))
+	errs := make([]error, len(shards))
+
+	var g errgroup.Group
+	for i, shard := range shards {
+		g.Go(func() error {
+			ctr := cypress.
+				WithServiceBinding("zoo-frontend", front).
+				WithEnvVariable("BASE_URL", "http://zoo-frontend").
+				WithExec([]string{"mkdir", "-p", "cypress/screenshots"})
+
+			if back != nil {
+				ctr = ctr.WithServiceBinding("zoo-backend", back)
+			}
+
+			title := fmt.Sprintf("Shard %d/%d (%s): %s", i+1, len(shards), opts.Browser, strings.Join(shard, ", "))
+
+			results[i], errs[i] = runStage(ctx, title, ctr, []string{
+				"npx", "cypress", "run",
+				"--browser", string(opts.Browser),
+				"--spec", strings.Join(shard, ","),
+				"--config", fmt.Sprintf("retries=%d", opts.Retries),
+			}, "cypress/screenshots")
+
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	err = errors.Join(errs...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := mergeResults("end-to-end tests", start, results)
+	for i, r := range results {
+		result.Artifacts = result.Artifacts.WithDirectory(fmt.Sprintf("shard-%d", i+1), r.Artifacts)
+	}
+
+	return result, nil
+}
+
+// shardSpecs splits the specs in, at most, n groups of similar size.
+func shardSpecs(specs []string, n int) [][]string {
+	if n < 1 {
+		n = 1
+	}
+	if n > len(specs) {
+		n = len(specs)
+	}
+
+	shards := make([][]string, n)
+	for i, spec := range specs {
+		shards[i%n] = append(shards[i%n], spec)
+	}
+
+	return shards
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"dagger/dagger/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type Provider string
+
+const (
+	// Detect the provider from the payload.
+	AUTO Provider = "auto"
+	// GitHub Actions, with the payload in `GITHUB_EVENT_PATH`.
+	GITHUB Provider = "github"
+	// GitLab, with the predefined 'CI_*' variables of the job, or the payload of its webhooks sent through a relay.
+	GITLAB Provider = "gitlab"
+	// Gitea or Forgejo Actions, whose payloads follow the ones of GitHub.
+	GITEA Provider = "gitea"
+)
+
+// The event that triggered a pipeline, whatever the CI provider that sent it.
+type EventInfo struct {
+	// The provider that sent the event.
+	Provider Provider
+
+	// The kind of event.
+	Event Event
+
+	// The branch that was pushed, or the source branch of the pull request.
+	Branch string
+
+	// The tag that was pushed or released.
+	Tag string
+
+	// Whether the event is a release, including the prereleases.
+	Release bool
+
+	// Whether the release is a prerelease.
+	Prerelease bool
+
+	// The name of the release, which its images are tagged with. Empty when the release has no name, so the tag is
+	// used.
+	ReleaseName string
+
+	// The number of the pull request, or of the merge request in GitLab.
+	PullRequest int
+
+	// The commit of the event.
+	Sha string
+
+	// The previous commit of the pushed branch.
+	Before string
+
+	// The user that triggered the event.
+	Actor string
+}
+
+// Returns the ref of the event, such as "refs/tags/v1.0.0".
+func (e *EventInfo) Ref() string {
+	if e.Tag != "" {
+		return "refs/tags/" + e.Tag
+	}
+
+	if e.Branch != "" {
+		return "refs/heads/" + e.Branch
+	}
+
+	return ""
+}
+
+// githubPayload is the part of the GitHub, Gitea and Forgejo payloads needed to know the event.
+type githubPayload struct {
+	Ref      string         `json:"ref"`
+	Before   string         `json:"before"`
+	After    string         `json:"after"`
+	Workflow string         `json:"workflow"`
+	Release  *githubRelease `json:"release"`
+	Pull     *githubPull    `json:"pull_request"`
+	Sender   struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+}
+
+type githubRelease struct {
+	Name       string `json:"name"`
+	TagName    string `json:"tag_name"`
+	Prerelease bool   `json:"prerelease"`
+}
+
+type githubPull struct {
+	Number int `json:"number"`
+	Head   struct {
+		Ref string `json:"ref"`
+		Sha string `json:"sha"`
+	} `json:"head"`
+}
+
+// gitlabPayload is the part of the GitLab webhook payloads needed to know the event.
+type gitlabPayload struct {
+	ObjectKind  string `json:"object_kind"`
+	Ref         string `json:"ref"`
+	Before      string `json:"before"`
+	After       string `json:"after"`
+	CheckoutSha string `json:"checkout_sha"`
+	Tag         string `json:"tag"`
+	Name        string `json:"name"`
+	Username    string `json:"user_username"`
+	User        struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Commit struct {
+		Id string `json:"id"`
+	} `json:"commit"`
+	ObjectAttributes struct {
+		Iid          int    `json:"iid"`
+		SourceBranch string `json:"source_branch"`
+		LastCommit   struct {
+			Id string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+// Parses the payload of the event that triggered the pipeline, sent by GitHub Actions, GitLab or Gitea and Forgejo Actions. For GitLab CI, the payload is the file with its 'CI_*' variables, since its jobs get no webhook payload.
+func (m *Ci) ParseEvent(
+	ctx context.Context,
+	// The payload of the event, e.g. the file in `GITHUB_EVENT_PATH`, or the "NAME=value" lines of the GitLab CI variables.
+	payload *dagger.File,
+	// The CI provider that sent the event.
+	// +default="auto"
+	provider Provider,
+) (*EventInfo, error) {
+	content, err := payload.Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseEvent([]byte(content), provider)
+}
+
+func parseEvent(content []byte, provider Provider) (*EventInfo, error) {
+	// The variables of a GitLab CI job are the only payload that is not JSON.
+	if isGitlabCiVariables(content) {
+		if provider != "" && provider != AUTO && provider != GITLAB {
+			return nil, fmt.Errorf("the GitLab CI variables cannot be parsed as a %s payload", provider)
+		}
+
+		return parseGitlabCiEvent(content)
+	}
+
+	if provider == "" || provider == AUTO {
+		var err error
+		provider, err = detectProvider(content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch provider {
+	case GITHUB, GITEA:
+		return parseGithubEvent(content, provider)
+	case GITLAB:
+		return parseGitlabEvent(content)
+	default:
+		return nil, fmt.Errorf("unknown provider %q", provider)
+	}
+}
+
+// The fields that only the repositories of Gitea and Forgejo have in their payloads.
+var giteaRepoFields = []string{"default_merge_style", "has_pull_requests", "internal_tracker"}
+
+// detectProvider tells the provider by the shape of the payload: only GitLab sends the kind of the event in it, only
+// GitHub gives a GraphQL 'node_id' to the repository, and only Gitea and Forgejo send the compare URL of a push as
+// 'compare_url' and their own settings of the repository, such as 'default_merge_style'. When none of them is found,
+// the provider has to be given.
+func detectProvider(content []byte) (Provider, error) {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(content, &keys); err != nil {
+		return "", fmt.Errorf("parsing the event payload: %w", err)
+	}
+
+	if _, ok := keys["object_kind"]; ok {
+		return GITLAB, nil
+	}
+
+	if _, ok := keys["compare_url"]; ok {
+		return GITEA, nil
+	}
+
+	var repo map[string]json.RawMessage
+	if raw, ok := keys["repository"]; ok {
+		if err := json.Unmarshal(raw, &repo); err != nil {
+			return "", fmt.Errorf("parsing the repository of the event payload: %w", err)
+		}
+	}
+
+	for _, field := range giteaRepoFields {
+		if _, ok := repo[field]; ok {
+			return GITEA, nil
+		}
+	}
+
+	if _, ok := repo["node_id"]; ok {
+		return GITHUB, nil
+	}
+
+	return "", fmt.Errorf("cannot tell the provider of the event payload, give it with 'provider'")
+}
+
+func parseGithubEvent(content []byte, provider Provider) (*EventInfo, error) {
+	var p githubPayload
+	if err := json.Unmarshal(content, &p); err != nil {
+		return nil, fmt.Errorf("parsing the %s event payload: %w", provider, err)
+	}
+
+	info := &EventInfo{Provider: provider, Actor: p.Sender.Login}
+
+	switch {
+	case p.Release != nil:
+		info.Release = true
+		info.Prerelease = p.Release.Prerelease
+		info.Tag = p.Release.TagName
+		info.ReleaseName = p.Release.Name
+		info.Event = RELEASE
+		if info.Prerelease {
+			info.Event = PRERELEASE
+		}
+	case p.Pull != nil:
+		info.Event = PULL_REQUEST
+		info.PullRequest = p.Pull.Number
+		info.Branch = p.Pull.Head.Ref
+		info.Sha = p.Pull.Head.Sha
+	case p.Workflow != "":
+		info.Event = DISPATCH
+		info.Branch, info.Tag = splitRef(p.Ref)
+	default:
+		info.Event = PUSH
+		info.Branch, info.Tag = splitRef(p.Ref)
+		info.Sha = p.After
+		info.Before = p.Before
+	}
+
+	return info, nil
+}
+
+// parseGitlabEvent parses the GitLab webhook payloads, which a GitLab CI job never receives, so they have to be sent to
+// it by a relay of the webhooks. GitLab releases have no prerelease flag, so a release of a
+// version with a prerelease part, such as "v1.0.0-rc.1", is a prerelease.
+func parseGitlabEvent(content []byte) (*EventInfo, error) {
+	var p gitlabPayload
+	if err := json.Unmarshal(content, &p); err != nil {
+		return nil, fmt.Errorf("parsing the gitlab event payload: %w", err)
+	}
+
+	// The pushes have the user at the top level, and the rest of the events in an object.
+	info := &EventInfo{Provider: GITLAB, Actor: p.Username}
+	if info.Actor == "" {
+		info.Actor = p.User.Username
+	}
+
+	switch p.ObjectKind {
+	case "push", "tag_push":
+		info.Event = PUSH
+		info.Branch, info.Tag = splitRef(p.Ref)
+		info.Sha = p.CheckoutSha
+		if info.Sha == "" {
+			info.Sha = p.After
+		}
+		info.Before = p.Before
+	case "release":
+		info.Release = true
+		info.Tag = p.Tag
+		info.ReleaseName = p.Name
+		info.Prerelease = strings.Contains(strings.TrimPrefix(p.Tag, "v"), "-")
+		info.Sha = p.Commit.Id
+		info.Event = RELEASE
+		if info.Prerelease {
+			info.Event = PRERELEASE
+		}
+	case "merge_request":
+		info.Event = PULL_REQUEST
+		info.PullRequest = p.ObjectAttributes.Iid
+		info.Branch = p.ObjectAttributes.SourceBranch
+		info.Sha = p.ObjectAttributes.LastCommit.Id
+	default:
+		return nil, fmt.Errorf("unsupported gitlab event %q", p.ObjectKind)
+	}
+
+	return info, nil
+}
+
+// The GitLab CI variables the event is read from.
+var gitlabCiVariables = []string{
+	"CI_PIPELINE_SOURCE",
+	"CI_COMMIT_SHA",
+	"CI_COMMIT_BEFORE_SHA",
+	"CI_COMMIT_BRANCH",
+	"CI_COMMIT_TAG",
+	"CI_MERGE_REQUEST_IID",
+	"CI_MERGE_REQUEST_SOURCE_BRANCH_NAME",
+	"GITLAB_USER_LOGIN",
+}
+
+// isGitlabCiVariables tells if the payload is a list of GitLab CI variables, as "NAME=value" lines.
+func isGitlabCiVariables(content []byte) bool {
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "CI_PIPELINE_SOURCE=") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseGitlabCiEvent parses the predefined variables of a GitLab CI job, one "NAME=value" per line, as written by:
+//
+//	for v in CI_PIPELINE_SOURCE CI_COMMIT_SHA ...; do echo "$v=$(printenv $v)"; done
+//
+// Only the variables in 'gitlabCiVariables' are read, and each one can only be given once, so that a value written
+// over several lines cannot set another one. A pipeline of a tag is a release, since GitLab releases are made from
+// their tags, and a prerelease when its version has a prerelease part, as with the webhooks. The pipelines run by
+// hand, through the API, a trigger or a schedule are dispatches.
+func parseGitlabCiEvent(content []byte) (*EventInfo, error) {
+	vars := map[string]string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || !slices.Contains(gitlabCiVariables, name) {
+			continue
+		}
+		if _, seen := vars[name]; seen {
+			return nil, fmt.Errorf("the GitLab CI variable %s is given more than once", name)
+		}
+		vars[name] = value
+	}
+
+	info := &EventInfo{Provider: GITLAB, Actor: vars["GITLAB_USER_LOGIN"], Sha: vars["CI_COMMIT_SHA"]}
+
+	// GitLab gives a zero SHA as the previous commit of new branches and merge requests.
+	if before := vars["CI_COMMIT_BEFORE_SHA"]; strings.Trim(before, "0") != "" {
+		info.Before = before
+	}
+
+	source := vars["CI_PIPELINE_SOURCE"]
+	switch {
+	case source == "merge_request_event":
+		iid, err := strconv.Atoi(vars["CI_MERGE_REQUEST_IID"])
+		if err != nil {
+			return nil, fmt.Errorf("parsing CI_MERGE_REQUEST_IID: %w", err)
+		}
+		info.Event = PULL_REQUEST
+		info.PullRequest = iid
+		info.Branch = vars["CI_MERGE_REQUEST_SOURCE_BRANCH_NAME"]
+		info.Before = ""
+	case source == "push" && vars["CI_COMMIT_TAG"] != "":
+		info.Release = true
+		info.Tag = vars["CI_COMMIT_TAG"]
+		info.Prerelease = strings.Contains(strings.TrimPrefix(info.Tag, "v"), "-")
+		info.Event = RELEASE
+		if info.Prerelease {
+			info.Event = PRERELEASE
+		}
+		info.Before = ""
+	case source == "push":
+		info.Event = PUSH
+		info.Branch = vars["CI_COMMIT_BRANCH"]
+	case slices.Contains([]string{"web", "api", "trigger", "schedule"}, source):
+		info.Event = DISPATCH
+		info.Branch = vars["CI_COMMIT_BRANCH"]
+		info.Tag = vars["CI_COMMIT_TAG"]
+		info.Before = ""
+	default:
+		return nil, fmt.Errorf("unsupported gitlab pipeline source %q", source)
+	}
+
+	return info, nil
+}
+
+// splitRef returns the branch or the tag of a ref such as "refs/heads/main".
+func splitRef(ref string) (string, string) {
+	if tag, ok := strings.CutPrefix(ref, "refs/tags/"); ok {
+		return "", tag
+	}
+
+	return strings.TrimPrefix(ref, "refs/heads/"), ""
+}
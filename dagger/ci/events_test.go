@@ -0,0 +1,618 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The payloads keep the fields of the real ones that tell the provider and the event, trimmed of the rest.
+
+const githubRepo = `"repository": {
+    "id": 912345678,
+    "node_id": "R_kgDONl2xzg",
+    "name": "zoo",
+    "full_name": "vieites-tfg/zoo",
+    "private": false,
+    "default_branch": "main",
+    "has_issues": true,
+    "has_projects": true,
+    "has_wiki": true
+  }`
+
+const githubSender = `"sender": {
+    "login": "vieitesss",
+    "id": 12345678,
+    "node_id": "MDQ6VXNlcjEyMzQ1Njc4",
+    "type": "User",
+    "site_admin": false
+  }`
+
+const giteaRepo = `"repository": {
+    "id": 42,
+    "owner": {"id": 1, "login": "vieites-tfg", "login_name": "", "full_name": ""},
+    "name": "zoo",
+    "full_name": "vieites-tfg/zoo",
+    "empty": false,
+    "private": false,
+    "internal": false,
+    "default_branch": "main",
+    "has_issues": true,
+    "internal_tracker": {"enable_time_tracker": true, "allow_only_contributors_to_track_time": true},
+    "has_wiki": true,
+    "has_pull_requests": true,
+    "default_merge_style": "merge"
+  }`
+
+const giteaSender = `"sender": {
+    "id": 1,
+    "login": "vieitesss",
+    "login_name": "",
+    "full_name": "",
+    "email": "vieitesss@noreply.localhost",
+    "is_admin": true
+  }`
+
+func TestParseEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		provider Provider
+		want     *EventInfo
+		wantErr  bool
+	}{
+		{
+			name: "github push",
+			payload: `{
+  "ref": "refs/heads/main",
+  "before": "1111111111111111111111111111111111111111",
+  "after": "2222222222222222222222222222222222222222",
+  "created": false,
+  "deleted": false,
+  "forced": false,
+  "compare": "https://github.com/vieites-tfg/zoo/compare/111111111111...222222222222",
+  "commits": [],
+  "head_commit": {"id": "2222222222222222222222222222222222222222", "message": "feat: add the keepers"},
+  "pusher": {"name": "vieitesss", "email": "dvieitest@gmail.com"},
+  ` + githubRepo + `,
+  ` + githubSender + `
+}`,
+			want: &EventInfo{
+				Provider: GITHUB,
+				Event:    PUSH,
+				Branch:   "main",
+				Sha:      "2222222222222222222222222222222222222222",
+				Before:   "1111111111111111111111111111111111111111",
+				Actor:    "vieitesss",
+			},
+		},
+		{
+			name: "github tag push",
+			payload: `{
+  "ref": "refs/tags/v1.0.0",
+  "before": "0000000000000000000000000000000000000000",
+  "after": "3333333333333333333333333333333333333333",
+  "created": true,
+  "base_ref": "refs/heads/main",
+  "compare": "https://github.com/vieites-tfg/zoo/compare/v1.0.0",
+  "commits": [],
+  ` + githubRepo + `,
+  ` + githubSender + `
+}`,
+			want: &EventInfo{
+				Provider: GITHUB,
+				Event:    PUSH,
+				Tag:      "v1.0.0",
+				Sha:      "3333333333333333333333333333333333333333",
+				Before:   "0000000000000000000000000000000000000000",
+				Actor:    "vieitesss",
+			},
+		},
+		{
+			name: "github release",
+			payload: `{
+  "action": "published",
+  "release": {
+    "id": 987654321,
+    "node_id": "RE_kwDONl2xzs4Ntm2h",
+    "tag_name": "v1.0.0",
+    "target_commitish": "main",
+    "name": "1.0.0",
+    "draft": false,
+    "prerelease": false
+  },
+  ` + githubRepo + `,
+  ` + githubSender + `
+}`,
+			want: &EventInfo{
+				Provider:    GITHUB,
+				Event:       RELEASE,
+				Tag:         "v1.0.0",
+				Release:     true,
+				ReleaseName: "1.0.0",
+				Actor:       "vieitesss",
+			},
+		},
+		{
+			name: "github prerelease",
+			payload: `{
+  "action": "prereleased",
+  "release": {
+    "id": 987654322,
+    "node_id": "RE_kwDONl2xzs4Ntm2i",
+    "tag_name": "v1.1.0-rc.1",
+    "target_commitish": "main",
+    "draft": false,
+    "prerelease": true
+  },
+  ` + githubRepo + `,
+  ` + githubSender + `
+}`,
+			want: &EventInfo{
+				Provider:   GITHUB,
+				Event:      PRERELEASE,
+				Tag:        "v1.1.0-rc.1",
+				Release:    true,
+				Prerelease: true,
+				Actor:      "vieitesss",
+			},
+		},
+		{
+			name: "github pull request",
+			payload: `{
+  "action": "opened",
+  "number": 7,
+  "pull_request": {
+    "id": 2345678901,
+    "node_id": "PR_kwDONl2xzs6L0pQ1",
+    "number": 7,
+    "state": "open",
+    "head": {"label": "vieitesss:keepers", "ref": "keepers", "sha": "4444444444444444444444444444444444444444"},
+    "base": {"label": "vieites-tfg:main", "ref": "main", "sha": "1111111111111111111111111111111111111111"}
+  },
+  ` + githubRepo + `,
+  ` + githubSender + `
+}`,
+			want: &EventInfo{
+				Provider:    GITHUB,
+				Event:       PULL_REQUEST,
+				Branch:      "keepers",
+				PullRequest: 7,
+				Sha:         "4444444444444444444444444444444444444444",
+				Actor:       "vieitesss",
+			},
+		},
+		{
+			name: "github workflow dispatch",
+			payload: `{
+  "inputs": {},
+  "ref": "refs/heads/main",
+  "workflow": ".github/workflows/cicd.yaml",
+  ` + githubRepo + `,
+  ` + githubSender + `
+}`,
+			want: &EventInfo{
+				Provider: GITHUB,
+				Event:    DISPATCH,
+				Branch:   "main",
+				Actor:    "vieitesss",
+			},
+		},
+		{
+			name: "gitlab push",
+			payload: `{
+  "object_kind": "push",
+  "event_name": "push",
+  "before": "1111111111111111111111111111111111111111",
+  "after": "2222222222222222222222222222222222222222",
+  "ref": "refs/heads/main",
+  "ref_protected": true,
+  "checkout_sha": "2222222222222222222222222222222222222222",
+  "user_id": 4,
+  "user_name": "David Vieites",
+  "user_username": "vieitesss",
+  "project_id": 15,
+  "project": {"id": 15, "name": "zoo", "path_with_namespace": "vieites-tfg/zoo", "default_branch": "main"},
+  "commits": [],
+  "total_commits_count": 1
+}`,
+			want: &EventInfo{
+				Provider: GITLAB,
+				Event:    PUSH,
+				Branch:   "main",
+				Sha:      "2222222222222222222222222222222222222222",
+				Before:   "1111111111111111111111111111111111111111",
+				Actor:    "vieitesss",
+			},
+		},
+		{
+			name: "gitlab tag push",
+			payload: `{
+  "object_kind": "tag_push",
+  "event_name": "tag_push",
+  "before": "0000000000000000000000000000000000000000",
+  "after": "5555555555555555555555555555555555555555",
+  "ref": "refs/tags/v1.0.0",
+  "ref_protected": true,
+  "checkout_sha": "3333333333333333333333333333333333333333",
+  "user_id": 4,
+  "user_name": "David Vieites",
+  "user_username": "vieitesss",
+  "project_id": 15,
+  "commits": [],
+  "total_commits_count": 0
+}`,
+			want: &EventInfo{
+				Provider: GITLAB,
+				Event:    PUSH,
+				Tag:      "v1.0.0",
+				Sha:      "3333333333333333333333333333333333333333",
+				Before:   "0000000000000000000000000000000000000000",
+				Actor:    "vieitesss",
+			},
+		},
+		{
+			name: "gitlab release",
+			payload: `{
+  "object_kind": "release",
+  "id": 1,
+  "created_at": "2026-10-19 10:00:00 UTC",
+  "description": "",
+  "name": "v1.0.0",
+  "released_at": "2026-10-19 10:00:00 UTC",
+  "tag": "v1.0.0",
+  "project": {"id": 15, "name": "zoo"},
+  "url": "https://gitlab.com/vieites-tfg/zoo/-/releases/v1.0.0",
+  "action": "create",
+  "commit": {"id": "3333333333333333333333333333333333333333", "message": "chore(release): publish"}
+}`,
+			want: &EventInfo{
+				Provider:    GITLAB,
+				Event:       RELEASE,
+				Tag:         "v1.0.0",
+				Release:     true,
+				ReleaseName: "v1.0.0",
+				Sha:         "3333333333333333333333333333333333333333",
+			},
+		},
+		{
+			name: "gitlab prerelease",
+			payload: `{
+  "object_kind": "release",
+  "id": 2,
+  "name": "v1.1.0-rc.1",
+  "tag": "v1.1.0-rc.1",
+  "action": "create",
+  "commit": {"id": "6666666666666666666666666666666666666666"}
+}`,
+			want: &EventInfo{
+				Provider:    GITLAB,
+				Event:       PRERELEASE,
+				Tag:         "v1.1.0-rc.1",
+				Release:     true,
+				ReleaseName: "v1.1.0-rc.1",
+				Prerelease:  true,
+				Sha:         "6666666666666666666666666666666666666666",
+			},
+		},
+		{
+			name: "gitlab merge request",
+			payload: `{
+  "object_kind": "merge_request",
+  "event_type": "merge_request",
+  "user": {"id": 4, "name": "David Vieites", "username": "vieitesss"},
+  "project": {"id": 15, "name": "zoo"},
+  "object_attributes": {
+    "id": 99,
+    "iid": 7,
+    "source_branch": "keepers",
+    "target_branch": "main",
+    "state": "opened",
+    "action": "open",
+    "last_commit": {"id": "4444444444444444444444444444444444444444", "message": "feat: add the keepers"}
+  }
+}`,
+			want: &EventInfo{
+				Provider:    GITLAB,
+				Event:       PULL_REQUEST,
+				Branch:      "keepers",
+				PullRequest: 7,
+				Sha:         "4444444444444444444444444444444444444444",
+				Actor:       "vieitesss",
+			},
+		},
+		{
+			name: "gitea push",
+			payload: `{
+  "ref": "refs/heads/main",
+  "before": "1111111111111111111111111111111111111111",
+  "after": "2222222222222222222222222222222222222222",
+  "compare_url": "https://gitea.example.com/vieites-tfg/zoo/compare/1111111111111111111111111111111111111111...2222222222222222222222222222222222222222",
+  "commits": [],
+  "total_commits": 1,
+  "head_commit": {"id": "2222222222222222222222222222222222222222", "message": "feat: add the keepers\n"},
+  ` + giteaRepo + `,
+  "pusher": {"id": 1, "login": "vieitesss"},
+  ` + giteaSender + `
+}`,
+			want: &EventInfo{
+				Provider: GITEA,
+				Event:    PUSH,
+				Branch:   "main",
+				Sha:      "2222222222222222222222222222222222222222",
+				Before:   "1111111111111111111111111111111111111111",
+				Actor:    "vieitesss",
+			},
+		},
+		{
+			name: "gitea tag push",
+			payload: `{
+  "ref": "refs/tags/v1.0.0",
+  "before": "0000000000000000000000000000000000000000",
+  "after": "3333333333333333333333333333333333333333",
+  "compare_url": "https://gitea.example.com/vieites-tfg/zoo/compare/0000000000000000000000000000000000000000...3333333333333333333333333333333333333333",
+  "commits": [],
+  "total_commits": 0,
+  ` + giteaRepo + `,
+  ` + giteaSender + `
+}`,
+			want: &EventInfo{
+				Provider: GITEA,
+				Event:    PUSH,
+				Tag:      "v1.0.0",
+				Sha:      "3333333333333333333333333333333333333333",
+				Before:   "0000000000000000000000000000000000000000",
+				Actor:    "vieitesss",
+			},
+		},
+		{
+			name: "gitea release",
+			payload: `{
+  "action": "published",
+  "release": {
+    "id": 3,
+    "tag_name": "v1.0.0",
+    "target_commitish": "main",
+    "name": "v1.0.0",
+    "url": "https://gitea.example.com/api/v1/repos/vieites-tfg/zoo/releases/3",
+    "draft": false,
+    "prerelease": false,
+    "author": {"id": 1, "login": "vieitesss"}
+  },
+  ` + giteaRepo + `,
+  ` + giteaSender + `
+}`,
+			want: &EventInfo{
+				Provider:    GITEA,
+				Event:       RELEASE,
+				Tag:         "v1.0.0",
+				Release:     true,
+				ReleaseName: "v1.0.0",
+				Actor:       "vieitesss",
+			},
+		},
+		{
+			name: "gitea prerelease",
+			payload: `{
+  "action": "published",
+  "release": {
+    "id": 4,
+    "tag_name": "v1.1.0-rc.1",
+    "target_commitish": "main",
+    "draft": false,
+    "prerelease": true,
+    "author": {"id": 1, "login": "vieitesss"}
+  },
+  ` + giteaRepo + `,
+  ` + giteaSender + `
+}`,
+			want: &EventInfo{
+				Provider:   GITEA,
+				Event:      PRERELEASE,
+				Tag:        "v1.1.0-rc.1",
+				Release:    true,
+				Prerelease: true,
+				Actor:      "vieitesss",
+			},
+		},
+		{
+			name: "gitea pull request",
+			payload: `{
+  "action": "opened",
+  "number": 7,
+  "pull_request": {
+    "id": 12,
+    "url": "https://gitea.example.com/vieites-tfg/zoo/pulls/7",
+    "number": 7,
+    "state": "open",
+    "head": {"label": "keepers", "ref": "keepers", "sha": "4444444444444444444444444444444444444444", "repo_id": 42},
+    "base": {"label": "main", "ref": "main", "sha": "1111111111111111111111111111111111111111", "repo_id": 42},
+    "merged": false
+  },
+  ` + giteaRepo + `,
+  ` + giteaSender + `,
+  "review": null
+}`,
+			want: &EventInfo{
+				Provider:    GITEA,
+				Event:       PULL_REQUEST,
+				Branch:      "keepers",
+				PullRequest: 7,
+				Sha:         "4444444444444444444444444444444444444444",
+				Actor:       "vieitesss",
+			},
+		},
+		{
+			name:     "provider given",
+			payload:  `{"ref": "refs/heads/main", "after": "2222222222222222222222222222222222222222", "sender": {"login": "vieitesss"}}`,
+			provider: GITEA,
+			want: &EventInfo{
+				Provider: GITEA,
+				Event:    PUSH,
+				Branch:   "main",
+				Sha:      "2222222222222222222222222222222222222222",
+				Actor:    "vieitesss",
+			},
+		},
+		{
+			name: "gitlab ci push",
+			payload: `CI_PIPELINE_SOURCE=push
+CI_COMMIT_SHA=2222222222222222222222222222222222222222
+CI_COMMIT_BEFORE_SHA=1111111111111111111111111111111111111111
+CI_COMMIT_BRANCH=main
+CI_COMMIT_TAG=
+CI_MERGE_REQUEST_IID=
+CI_MERGE_REQUEST_SOURCE_BRANCH_NAME=
+GITLAB_USER_LOGIN=vieitesss
+`,
+			want: &EventInfo{
+				Provider: GITLAB,
+				Event:    PUSH,
+				Branch:   "main",
+				Sha:      "2222222222222222222222222222222222222222",
+				Before:   "1111111111111111111111111111111111111111",
+				Actor:    "vieitesss",
+			},
+		},
+		{
+			name: "gitlab ci push of a new branch",
+			payload: `CI_PIPELINE_SOURCE=push
+CI_COMMIT_SHA=2222222222222222222222222222222222222222
+CI_COMMIT_BEFORE_SHA=0000000000000000000000000000000000000000
+CI_COMMIT_BRANCH=feature
+GITLAB_USER_LOGIN=vieitesss
+`,
+			want: &EventInfo{
+				Provider: GITLAB,
+				Event:    PUSH,
+				Branch:   "feature",
+				Sha:      "2222222222222222222222222222222222222222",
+				Actor:    "vieitesss",
+			},
+		},
+		{
+			name:     "gitlab ci release",
+			provider: GITLAB,
+			payload: `CI_PIPELINE_SOURCE=push
+CI_COMMIT_SHA=3333333333333333333333333333333333333333
+CI_COMMIT_BEFORE_SHA=0000000000000000000000000000000000000000
+CI_COMMIT_BRANCH=
+CI_COMMIT_TAG=v1.0.0
+GITLAB_USER_LOGIN=vieitesss
+`,
+			want: &EventInfo{
+				Provider: GITLAB,
+				Event:    RELEASE,
+				Tag:      "v1.0.0",
+				Release:  true,
+				Sha:      "3333333333333333333333333333333333333333",
+				Actor:    "vieitesss",
+			},
+		},
+		{
+			name: "gitlab ci prerelease",
+			payload: `CI_PIPELINE_SOURCE=push
+CI_COMMIT_SHA=6666666666666666666666666666666666666666
+CI_COMMIT_TAG=v1.1.0-rc.1
+GITLAB_USER_LOGIN=vieitesss
+`,
+			want: &EventInfo{
+				Provider:   GITLAB,
+				Event:      PRERELEASE,
+				Tag:        "v1.1.0-rc.1",
+				Release:    true,
+				Prerelease: true,
+				Sha:        "6666666666666666666666666666666666666666",
+				Actor:      "vieitesss",
+			},
+		},
+		{
+			name: "gitlab ci merge request",
+			payload: `CI_PIPELINE_SOURCE=merge_request_event
+CI_COMMIT_SHA=4444444444444444444444444444444444444444
+CI_COMMIT_BEFORE_SHA=0000000000000000000000000000000000000000
+CI_MERGE_REQUEST_IID=7
+CI_MERGE_REQUEST_SOURCE_BRANCH_NAME=feature
+GITLAB_USER_LOGIN=vieitesss
+`,
+			want: &EventInfo{
+				Provider:    GITLAB,
+				Event:       PULL_REQUEST,
+				PullRequest: 7,
+				Branch:      "feature",
+				Sha:         "4444444444444444444444444444444444444444",
+				Actor:       "vieitesss",
+			},
+		},
+		{
+			name: "gitlab ci run by hand",
+			payload: `CI_PIPELINE_SOURCE=web
+CI_COMMIT_SHA=2222222222222222222222222222222222222222
+CI_COMMIT_BEFORE_SHA=1111111111111111111111111111111111111111
+CI_COMMIT_BRANCH=main
+GITLAB_USER_LOGIN=vieitesss
+`,
+			want: &EventInfo{
+				Provider: GITLAB,
+				Event:    DISPATCH,
+				Branch:   "main",
+				Sha:      "2222222222222222222222222222222222222222",
+				Actor:    "vieitesss",
+			},
+		},
+		{
+			name:    "gitlab ci variable given twice",
+			payload: "CI_PIPELINE_SOURCE=push\nCI_COMMIT_BRANCH=main\nCI_COMMIT_BRANCH=other\n",
+			wantErr: true,
+		},
+		{
+			name:    "unsupported gitlab ci pipeline source",
+			payload: "CI_PIPELINE_SOURCE=parent_pipeline\nCI_COMMIT_BRANCH=main\n",
+			wantErr: true,
+		},
+		{
+			name:     "gitlab ci variables as another provider",
+			provider: GITHUB,
+			payload:  "CI_PIPELINE_SOURCE=push\nCI_COMMIT_BRANCH=main\n",
+			wantErr:  true,
+		},
+		{
+			name:    "unknown provider",
+			payload: `{"ref": "refs/heads/main", "after": "2222222222222222222222222222222222222222"}`,
+			wantErr: true,
+		},
+		{
+			name:    "unsupported gitlab event",
+			payload: `{"object_kind": "note"}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid payload",
+			payload: `{"ref": `,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := tt.provider
+			if provider == "" {
+				provider = AUTO
+			}
+
+			got, err := parseEvent([]byte(tt.payload), provider)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseEvent = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
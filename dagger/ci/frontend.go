@@ -50,63 +50,146 @@ func (m *Frontend) Service(ctx context.Context) *dagger.Service {
 	return m.Ctr(ctx).AsService().WithHostname("zoo-frontend")
 }
 
-// Runs the linter for the package.
-func (m *Frontend) Lint(ctx context.Context) (string, error) {
-	return Lint(ctx, m.Base, m.Name)
+// Runs the linter for the package, returning its reports even when it fails. With fix, the fixable problems are fixed and the patched sources of the package are returned.
+func (m *Frontend) Lint(
+	ctx context.Context,
+	// Fix the fixable problems.
+	// +optional
+	fix bool,
+) (*StageResult, error) {
+	return Lint(ctx, m.Base, m.Name, fix)
 }
 
-// Run the e2e test. This requires to have both the backend and frontend services up and running correctly. You have to pass the frontend service as an argument to the function.
+// Run the e2e test against the whole application. The services that are not given are started from the source: the Mongo database, the backend and the frontend. The specs can be filtered, retried and split across parallel containers, whose outputs are merged.
 func (m *Frontend) Test(
 	ctx context.Context,
 	// +defaultPath="/"
 	src *dagger.Directory,
+	// Database the backend connects to, reachable at port 'MONGO_PORT'. Ignored when a backend is given.
+	// +optional
+	mongo *dagger.Service,
+	// Backend the frontend calls, reachable at port 3000.
+	// +optional
+	back *dagger.Service,
+	// Frontend the specs are run against, reachable at port 80.
+	// +optional
 	front *dagger.Service,
-) (string, error) {
-	return Cypress(src).
-		WithServiceBinding("zoo-frontend", front).
-		WithExec([]string{"yarn", "run", "e2e"}).
-		Stdout(ctx)
+	// Browser in which the specs are run.
+	// +default="electron"
+	browser Browser,
+	// Glob of the specs to run, relative to the frontend package, e.g. "cypress/e2e/home.cy.ts".
+	// +default="cypress/e2e/**/*.cy.ts"
+	spec string,
+	// Times a failed test is retried.
+	// +optional
+	retries int,
+	// Number of containers the specs are split across.
+	// +default=1
+	shards int,
+) (*StageResult, error) {
+	back, front, err := m.Ci.e2eServices(ctx, src, mongo, back, front)
+	if err != nil {
+		return nil, err
+	}
+
+	return runCypress(ctx, src, front, back, cypressOpts{
+		Browser: browser,
+		Spec:    spec,
+		Retries: retries,
+		Shards:  shards,
+	})
+}
+
+// verify runs 'Endtoend' over the sources, unless they are already verified.
+func (m *Frontend) verify(ctx context.Context, src *dagger.Directory, token string) error {
+	ok, err := isVerified(ctx, src, token)
+	if err != nil || ok {
+		return err
+	}
+
+	_, err = m.Ci.Verify(ctx, src)
+
+	return err
 }
 
-// Publish the Docker image of the package with the "latest" and the npm package (inside the 'package.json') versions.
+// Publish the Docker image of the package with the "latest" and the npm package (inside the 'package.json') versions. Nothing is published when the dependency scan finds violations of the policy, and its result is returned instead.
 func (m *Frontend) PublishImage(
 	ctx context.Context,
 	// +defaultPath="/"
 	src *dagger.Directory,
 	tag string,
-) (string, error) {
-	var err error
-
-	_, err = m.Lint(ctx)
+	// Token returned by 'verify' for the sources, to skip their verification.
+	// +optional
+	verified string,
+	// Snapshot of the advisory database the dependencies are scanned against. By default, a new one is downloaded.
+	// +optional
+	advisories *dagger.Directory,
+) (*StageResult, error) {
+	err := m.verify(ctx, src, verified)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	_, err = m.Ci.Endtoend(ctx, src)
+	scan, err := ScanDependencies(ctx, m.Base, src, advisories, m.Name)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	return m.publishImage(ctx, tag, scan)
+}
+
+// publishImage publishes the Docker image of the verified sources, given the result of the scan of their dependencies,
+// which is returned instead when it failed.
+func (m *Frontend) publishImage(ctx context.Context, tag string, scan *StageResult) (*StageResult, error) {
+	if scan.Status == FAILED {
+		return scan, nil
 	}
 
 	return PublishImage(ctx, m.Ctr(ctx), m.Name, m.Secrets.Get("CR_PAT"), tag)
 }
 
-// Publish the npm package.
+// Publish the npm package, unless its version is already in the registry. Nothing is published when the dependency scan finds violations of the policy, and its result is returned instead.
 func (m *Frontend) PublishPkg(
 	ctx context.Context,
 	// +defaultPath="/"
 	src *dagger.Directory,
-) (string, error) {
-	var err error
-
-	_, err = m.Lint(ctx)
+	// The dist-tag the version is published with.
+	// +default="latest"
+	distTag string,
+	// Check everything, including the registry, without publishing the package.
+	// +optional
+	dryRun bool,
+	// Publish to a local Verdaccio registry, to try the publication.
+	// +optional
+	local bool,
+	// Token returned by 'verify' for the sources, to skip their verification.
+	// +optional
+	verified string,
+	// Snapshot of the advisory database the dependencies are scanned against. By default, a new one is downloaded.
+	// +optional
+	advisories *dagger.Directory,
+) (*StageResult, error) {
+	err := m.verify(ctx, src, verified)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	_, err = m.Ci.Endtoend(ctx, src)
+	scan, err := ScanDependencies(ctx, m.Base, src, advisories, m.Name)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if scan.Status == FAILED {
+		return scan, nil
 	}
 
-	return PublishPkg(ctx, m.Base, m.Name, m.Secrets.Get("CR_PAT"))
+	return PublishPkg(ctx, m.Base, m.Name, m.Secrets.Get("CR_PAT"), publishOpts{
+		Local:  local,
+		Tag:    distTag,
+		DryRun: dryRun,
+	})
+}
+
+// Returns the tarball of the npm package, as it would be published.
+func (m *Frontend) Pack(ctx context.Context) (*dagger.File, error) {
+	return PackPkg(ctx, m.Base, m.Name)
 }
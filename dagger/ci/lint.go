@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"dagger/dagger/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The directory of the container the linter writes its reports to.
+const lintReports = "/reports"
+
+// eslintFile is the report of a file, as written by the JSON formatter of ESLint.
+type eslintFile struct {
+	FilePath     string          `json:"filePath"`
+	Messages     []eslintMessage `json:"messages"`
+	ErrorCount   int             `json:"errorCount"`
+	WarningCount int             `json:"warningCount"`
+}
+
+type eslintMessage struct {
+	// Empty for the parsing errors, which have no rule.
+	RuleId    string `json:"ruleId"`
+	Severity  int    `json:"severity"`
+	Message   string `json:"message"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	EndLine   int    `json:"endLine"`
+	EndColumn int    `json:"endColumn"`
+}
+
+// Lint runs ESLint over the package and returns its result, even when there are errors, with the reports in
+// 'eslint.json' and 'eslint.sarif' as artifacts. With fix, the fixable problems are fixed, and the patched sources of
+// the package are returned as the fixed ones.
+func Lint(ctx context.Context, base *dagger.Container, pkg string, fix bool) (*StageResult, error) {
+	dir := fmt.Sprintf("/app/packages/%s", pkg)
+
+	ctr := base.
+		WithWorkdir(dir).
+		WithExec([]string{"mkdir", "-p", lintReports})
+
+	args := []string{"yarn", "lint", "--format", "json", "--output-file", lintReports + "/eslint.json"}
+	if fix {
+		args = append(args, "--fix")
+	}
+
+	ctr, result, err := execStage(ctx, pkg+" lint", ctr, args, lintReports)
+	if err != nil {
+		return nil, err
+	}
+
+	if fix {
+		result.Fixed = dag.
+			Directory().
+			WithDirectory(".", ctr.Directory(dir), dagger.DirectoryWithDirectoryOpts{Exclude: []string{"node_modules/", "dist/"}})
+	}
+
+	// ESLint writes no report when it crashes, e.g. with a wrong configuration, so its output is kept as it is.
+	reports, err := result.Artifacts.Glob(ctx, "eslint.json")
+	if err != nil {
+		return nil, err
+	}
+	if len(reports) == 0 {
+		return result, nil
+	}
+
+	content, err := result.Artifacts.File("eslint.json").Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []eslintFile
+	err = json.Unmarshal([]byte(content), &files)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the ESLint report of %s: %w", pkg, err)
+	}
+
+	for _, file := range files {
+		result.Errors += file.ErrorCount
+		result.Warnings += file.WarningCount
+	}
+
+	diags := eslintDiagnostics(files)
+
+	sarif, err := toSarif("ESLint", "https://eslint.org", diags)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Artifacts = result.Artifacts.WithNewFile("eslint.sarif", sarif)
+	result.Stdout = diagnosticsSummary(diags, result.Errors, result.Warnings)
+
+	return result, nil
+}
+
+// Lints every package, going on when one of them fails, and returns their reports together, with the total number of errors and warnings. The reports of each package are in its own directory of the artifacts. With fix, the fixable problems are fixed, and the fixed files are returned at the same path as in the repository, ready to be exported over it.
+func (m *Ci) Lint(
+	ctx context.Context,
+	// +defaultPath="/"
+	src *dagger.Directory,
+	// Fix the fixable problems.
+	// +optional
+	fix bool,
+) (*StageResult, error) {
+	back, err := m.Backend(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+
+	front, err := m.Frontend(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+
+	var results []*StageResult
+	for _, lint := range []func(context.Context, bool) (*StageResult, error){back.Lint, front.Lint} {
+		result, err := lint(ctx, fix)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	merged := mergeResults("lint", start, results)
+	for i, pkg := range []string{back.Name, front.Name} {
+		merged.Artifacts = merged.Artifacts.WithDirectory(pkg, results[i].Artifacts)
+		merged.Fixed = merged.Fixed.WithDirectory("packages/"+pkg, results[i].Fixed)
+	}
+
+	return merged, nil
+}
+
+// diagnostic is a problem reported by a checker, such as the linter or the compiler, in a file of the repository. The
+// location is empty for the problems of the whole package, such as a wrong configuration.
+type diagnostic struct {
+	File      string `json:"file"`
+	Line      int    `json:"line,omitempty"`
+	Column    int    `json:"column,omitempty"`
+	EndLine   int    `json:"endLine,omitempty"`
+	EndColumn int    `json:"endColumn,omitempty"`
+	// "error" or "warning".
+	Severity string `json:"severity"`
+	// The rule or the code of the problem, e.g. "no-unused-vars" or "TS2322". Empty when it has none.
+	Rule    string `json:"rule,omitempty"`
+	Message string `json:"message"`
+}
+
+// eslintDiagnostics returns the problems of the ESLint report, with the paths relative to the root of the repository.
+func eslintDiagnostics(files []eslintFile) []diagnostic {
+	var diags []diagnostic
+	for _, file := range files {
+		for _, msg := range file.Messages {
+			severity := "warning"
+			if msg.Severity == 2 {
+				severity = "error"
+			}
+
+			diags = append(diags, diagnostic{
+				File:      relativePath(file.FilePath),
+				Line:      msg.Line,
+				Column:    msg.Column,
+				EndLine:   msg.EndLine,
+				EndColumn: msg.EndColumn,
+				Severity:  severity,
+				Rule:      msg.RuleId,
+				Message:   msg.Message,
+			})
+		}
+	}
+
+	return diags
+}
+
+// diagnosticsSummary returns the diagnostics, one per line, as "file:line:column severity message (rule)", followed
+// by their totals.
+func diagnosticsSummary(diags []diagnostic, errors int, warnings int) string {
+	var b strings.Builder
+
+	for _, d := range diags {
+		location := d.File
+		if d.Line != 0 {
+			location = fmt.Sprintf("%s:%d:%d", d.File, d.Line, d.Column)
+		}
+
+		fmt.Fprintf(&b, "%s %s %s", location, d.Severity, d.Message)
+		if d.Rule != "" {
+			fmt.Fprintf(&b, " (%s)", d.Rule)
+		}
+		b.WriteString("\n")
+	}
+
+	fmt.Fprintf(&b, "%d errors, %d warnings\n", errors, warnings)
+
+	return b.String()
+}
+
+// SARIF 2.1.0, with only the fields needed to report the diagnostics.
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver struct {
+		Name           string      `json:"name"`
+		InformationUri string      `json:"informationUri"`
+		Rules          []sarifRule `json:"rules"`
+	} `json:"driver"`
+}
+
+type sarifRule struct {
+	Id string `json:"id"`
+}
+
+type sarifResult struct {
+	RuleId    string          `json:"ruleId,omitempty"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			Uri       string `json:"uri"`
+			UriBaseId string `json:"uriBaseId"`
+		} `json:"artifactLocation"`
+		Region sarifRegion `json:"region"`
+	} `json:"physicalLocation"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine,omitempty"`
+	StartColumn int `json:"startColumn,omitempty"`
+	EndLine     int `json:"endLine,omitempty"`
+	EndColumn   int `json:"endColumn,omitempty"`
+}
+
+// toSarif converts the diagnostics of a tool to SARIF, so that they can be uploaded to code scanning tools.
+func toSarif(tool string, uri string, diags []diagnostic) (string, error) {
+	run := sarifRun{Results: []sarifResult{}}
+	run.Tool.Driver.Name = tool
+	run.Tool.Driver.InformationUri = uri
+
+	rules := map[string]bool{}
+	for _, d := range diags {
+		var location sarifLocation
+		location.PhysicalLocation.ArtifactLocation.Uri = d.File
+		location.PhysicalLocation.ArtifactLocation.UriBaseId = "%SRCROOT%"
+		location.PhysicalLocation.Region = sarifRegion{
+			StartLine:   d.Line,
+			StartColumn: d.Column,
+			EndLine:     d.EndLine,
+			EndColumn:   d.EndColumn,
+		}
+
+		run.Results = append(run.Results, sarifResult{
+			RuleId:    d.Rule,
+			Level:     d.Severity,
+			Message:   sarifMessage{Text: d.Message},
+			Locations: []sarifLocation{location},
+		})
+
+		if d.Rule != "" {
+			rules[d.Rule] = true
+		}
+	}
+
+	run.Tool.Driver.Rules = []sarifRule{}
+	for id := range rules {
+		run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{Id: id})
+	}
+	sort.Slice(run.Tool.Driver.Rules, func(i, j int) bool {
+		return run.Tool.Driver.Rules[i].Id < run.Tool.Driver.Rules[j].Id
+	})
+
+	out, err := json.MarshalIndent(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+// relativePath returns the path of a file of the base container relative to the root of the repository.
+func relativePath(path string) string {
+	return strings.TrimPrefix(path, "/app/")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"dagger/dagger/internal/dagger"
+	"fmt"
+	"time"
+)
+
+// Runs a k6 load test against the backend, started with a database seeded with the 'mongo-init' scripts. The output of the result is the summary, with the latency percentiles and the error rates as JSON, also in 'summary.json' as an artifact. The result fails when the SLO thresholds are exceeded, and the summary is still returned with it.
+func (m *Backend) LoadTest(
+	ctx context.Context,
+	// +defaultPath="/"
+	src *dagger.Directory,
+	// k6 scenario to run. Defaults to the CRUD scenario of the '/animals' endpoints.
+	// +optional
+	scenario *dagger.File,
+	// Maximum 95th percentile of the request duration, in milliseconds.
+	// +default=300
+	p95 int,
+	// Maximum 99th percentile of the request duration, in milliseconds.
+	// +default=800
+	p99 int,
+	// Maximum rate of failed requests, between 0 and 1.
+	// +default="0.01"
+	maxErrorRate string,
+	// Number of virtual users sending requests at the same time.
+	// +default=10
+	vus int,
+	// How long the virtual users keep sending requests, after the ramp up.
+	// +default="30s"
+	duration string,
+) (*StageResult, error) {
+	if scenario == nil {
+		scenario = src.File("packages/backend/tests/load/animals.js")
+	}
+	if p95 == 0 {
+		p95 = 300
+	}
+	if p99 == 0 {
+		p99 = 800
+	}
+	if maxErrorRate == "" {
+		maxErrorRate = "0.01"
+	}
+	if vus == 0 {
+		vus = 10
+	}
+	if duration == "" {
+		duration = "30s"
+	}
+
+	// The scenario creates and deletes animals, so it gets its own database.
+	back := *m
+	back.Mongo = m.Mongo.WithRunId("load")
+
+	svc, err := back.Service(ctx, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer svc.Stop(ctx)
+
+	k6 := dag.
+		Container().
+		From("grafana/k6:0.57.0").
+		WithServiceBinding("zoo-backend", svc).
+		WithFile("/scenarios/scenario.js", scenario).
+		WithEnvVariable("BASE_URL", "http://zoo-backend:3000").
+		WithEnvVariable("P95_MS", fmt.Sprint(p95)).
+		WithEnvVariable("P99_MS", fmt.Sprint(p99)).
+		WithEnvVariable("MAX_ERROR_RATE", maxErrorRate).
+		WithEnvVariable("VUS", fmt.Sprint(vus)).
+		WithEnvVariable("DURATION", duration).
+		WithEnvVariable("SUMMARY_FILE", "/tmp/summary/summary.json").
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{"mkdir", "-p", "/tmp/summary"})
+
+	result, err := runStage(ctx, "backend load test", k6, []string{"k6", "run", "--quiet", "/scenarios/scenario.js"}, "/tmp/summary")
+	if err != nil {
+		return nil, err
+	}
+
+	summary, err := result.Artifacts.File("summary.json").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("k6 exited with code %d without a summary: %s", result.ExitCode, result.Stderr)
+	}
+	result.Stdout = summary
+
+	// k6 exits with 99 when a threshold is exceeded.
+	if result.ExitCode == 99 {
+		result.Stderr = "the SLO thresholds were exceeded\n" + result.Stderr
+	}
+
+	return result, nil
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"dagger/dagger/internal/dagger"
+	"fmt"
+	"slices"
 )
 
 type Ci struct {
@@ -19,26 +21,30 @@ func New(secEnv *dagger.Secret) *Ci {
 	}
 }
 
-// Builds the base image from the Dockerfile.
+// Builds the base image with the dependencies installed. They are installed from the manifests only, so the install is cached until they change, and only the yarn cache is kept in a volume. lerna and ncc are the ones in the lockfile.
 func (m *Ci) Base(
 	ctx context.Context,
 	// +defaultPath="/"
 	src *dagger.Directory,
 ) (*dagger.Container, error) {
+	manifests := dag.
+		Directory().
+		WithFile("package.json", src.File("package.json")).
+		WithFile("lerna.json", src.File("lerna.json")).
+		WithFile("yarn.lock", src.File("yarn.lock")).
+		WithDirectory("packages", src.Directory("packages"), dagger.DirectoryWithDirectoryOpts{Include: []string{"*/package.json"}})
+
 	ctr := dag.
 		Container().
 		From("node:20").
 		WithWorkdir("/app").
-		WithFile("package.json", src.File("package.json")).
-		WithFile("lerna.json", src.File("lerna.json")).
-		WithFile("yarn.lock", src.File("yarn.lock")).
-		WithDirectory("packages", src.Directory("packages")).
-		WithDirectory(".git", src.Directory(".git")).
+		WithDirectory(".", manifests).
 		WithMountedCache("/.yarn/cache", dag.CacheVolume("yarn-cache")).
 		WithEnvVariable("YARN_CACHE_FOLDER", "/.yarn/cache").
-		WithExec([]string{"yarn", "install"}).
-		WithExec([]string{"yarn", "global", "add", "lerna@8.2.1"}).
-		WithExec([]string{"yarn", "global", "add", "@vercel/ncc"})
+		WithExec([]string{"yarn", "install", "--frozen-lockfile"}).
+		WithEnvVariable("PATH", "/app/node_modules/.bin:${PATH}", dagger.ContainerWithEnvVariableOpts{Expand: true}).
+		WithDirectory("packages", src.Directory("packages"), dagger.ContainerWithDirectoryOpts{Exclude: []string{"*/node_modules/", "*/dist/"}}).
+		WithDirectory(".git", src.Directory(".git"))
 
 	return ctr, nil
 }
@@ -54,17 +60,24 @@ func (m *Ci) Init(
 		return nil, err
 	}
 
-	content, err := m.SecEnv.Plaintext(ctx)
+	err = m.loadSecrets(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	m.secrets, err = MakeSecrets(ctx, content)
+	return ctr, nil
+}
+
+// loadSecrets reads the .env environment variables as secrets.
+func (m *Ci) loadSecrets(ctx context.Context) error {
+	content, err := m.SecEnv.Plaintext(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return ctr, nil
+	m.secrets, err = MakeSecrets(ctx, content)
+
+	return err
 }
 
 // Functions related to the backend package.
@@ -78,18 +91,58 @@ func (m *Ci) Backend(
 		return nil, err
 	}
 
-	keys := []string{"MONGO_PORT", "MONGO_DATABASE", "MONGO_ROOT", "MONGO_ROOT_PASS", "CR_PAT"}
+	keys := []string{"CR_PAT"}
+	values := []*dagger.Secret{m.secrets["CR_PAT"]}
+
+	mongo, err := m.Mongo(ctx, "", "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Backend{
+		Name:    "backend",
+		Base:    base,
+		Secrets: SecMap{Keys: keys, Values: values},
+		Mongo:   mongo.WithFixtures(src.Directory("mongo-init")),
+		Ci:      m,
+	}, nil
+}
+
+// The Mongo database used by the backend and its tests.
+func (m *Ci) Mongo(
+	ctx context.Context,
+	// The tag of the mongo image.
+	// +optional
+	// +default="7.0"
+	version string,
+	// A cache volume to keep the data between runs. By default, the data is lost when the service stops.
+	// +optional
+	volume string,
+	// Gives a fresh database to the run, different from the one of any other run id.
+	// +optional
+	runId string,
+) (*Mongo, error) {
+	if version == "" {
+		version = "7.0"
+	}
+
+	err := m.loadSecrets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{"MONGO_PORT", "MONGO_DATABASE", "MONGO_ROOT", "MONGO_ROOT_PASS"}
 	values := []*dagger.Secret{
 		m.secrets["MONGO_PORT"],
 		m.secrets["MONGO_DATABASE"],
 		m.secrets["MONGO_ROOT"],
 		m.secrets["MONGO_ROOT_PASS"],
-		m.secrets["CR_PAT"],
 	}
 
-	return &Backend{
-		Name:    "backend",
-		Base:    base,
+	return &Mongo{
+		Version: version,
+		Volume:  volume,
+		RunId:   runId,
 		Secrets: SecMap{Keys: keys, Values: values},
 	}, nil
 }
@@ -116,62 +169,155 @@ func (m *Ci) Frontend(
 	}, nil
 }
 
-// Runs the linter and the tests for both the frontend and the backend.
-func (m *Ci) Endtoend(
+// Functions related to the Helm charts of the packages.
+func (m *Ci) Charts(
 	ctx context.Context,
 	// +defaultPath="/"
 	src *dagger.Directory,
-) (string, error) {
-	back, err := m.Backend(ctx, src)
+) (*Charts, error) {
+	err := m.loadSecrets(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	front, err := m.Frontend(ctx, src)
+	charts, err := chartsDir(ctx, src)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	// Linter
-	_, err = back.Lint(ctx)
+	keys := []string{"CR_PAT"}
+	values := []*dagger.Secret{m.secrets["CR_PAT"]}
+
+	return &Charts{
+		Src:     src,
+		Base:    HelmBase(charts),
+		Secrets: SecMap{Keys: keys, Values: values},
+	}, nil
+}
+
+// Runs the linter, the type checker and the tests for both the frontend and the backend, or only for the packages affected since a commit, and returns the result of every stage. The stages after a failed one are skipped, except after the linter and the type checker, which let them run and only fail the whole run. The results are returned even when a stage fails, so their output and artifacts can be read, and 'verify' is the one that fails then.
+func (m *Ci) Endtoend(
+	ctx context.Context,
+	// +defaultPath="/"
+	src *dagger.Directory,
+	// Browser in which the e2e specs are run.
+	// +default="electron"
+	browser Browser,
+	// Glob of the e2e specs to run, relative to the frontend package.
+	// +default="cypress/e2e/**/*.cy.ts"
+	spec string,
+	// Times a failed e2e test is retried.
+	// +optional
+	retries int,
+	// Number of containers the e2e specs are split across.
+	// +default=1
+	shards int,
+	// Only lint and test the packages affected since this commit. The e2e tests are run when any package is affected. By default, every package is processed.
+	// +optional
+	base string,
+	// Commit with the changes, when only the affected packages are processed.
+	// +default="HEAD"
+	head string,
+) ([]*StageResult, error) {
+	back, err := m.Backend(ctx, src)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	_, err = front.Lint(ctx)
+	front, err := m.Frontend(ctx, src)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	// Backend tests
-	_, err = back.Test(ctx)
-	if err != nil {
-		return "", err
+	affected := []string{back.Name, front.Name}
+	if base != "" {
+		affected, err = m.Affected(ctx, src, base, head)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Frontend tests
-	backSvc, err := back.Service(ctx, src)
-	if err != nil {
-		return "", err
+	// The linters of 'Endtoend' only report the problems, without fixing them.
+	lint := func(fn func(context.Context, bool) (*StageResult, error)) func(context.Context) (*StageResult, error) {
+		return func(ctx context.Context) (*StageResult, error) {
+			return fn(ctx, false)
+		}
 	}
 
-	backendSvc, err := backSvc.Start(ctx)
-	if err != nil {
-		return "", err
+	stages := []struct {
+		Name string
+		// The package the stage belongs to, if any. Only the stages of the affected packages are run.
+		Pkg string
+		// Whether the next stages run when this one fails, as they do after the linter and the type checker.
+		Continue bool
+		Run      func(context.Context) (*StageResult, error)
+	}{
+		{"backend lint", back.Name, true, lint(back.Lint)},
+		{"frontend lint", front.Name, true, lint(front.Lint)},
+		{"backend typecheck", back.Name, true, back.Typecheck},
+		{"frontend typecheck", front.Name, true, front.Typecheck},
+		{"backend unit tests", back.Name, false, back.Test},
+		{"backend integration tests", back.Name, false, func(ctx context.Context) (*StageResult, error) {
+			return back.IntegrationTest(ctx, src)
+		}},
+		{"end-to-end tests", "", false, func(ctx context.Context) (*StageResult, error) {
+			backendSvc, frontendSvc, err := m.e2eServices(ctx, src, nil, nil, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			return runCypress(ctx, src, frontendSvc, backendSvc, cypressOpts{
+				Browser: browser,
+				Spec:    spec,
+				Retries: retries,
+				Shards:  shards,
+			})
+		}},
 	}
 
-	frontendSvc, err := front.Service(ctx).Start(ctx)
-	if err != nil {
-		return "", err
+	var (
+		results []*StageResult
+		// The results of the stages that stop the next ones when they fail.
+		blocking []*StageResult
+	)
+
+	for _, s := range stages {
+		switch {
+		case len(affected) == 0:
+			results = append(results, skipped(s.Name, "No package is affected."))
+			continue
+		case s.Pkg != "" && !slices.Contains(affected, s.Pkg):
+			results = append(results, skipped(s.Name, fmt.Sprintf("The %s package is not affected.", s.Pkg)))
+			continue
+		case failed(blocking) != nil:
+			results = append(results, skipped(s.Name, "A previous stage failed."))
+			continue
+		}
+
+		result, err := s.Run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		result.Name = s.Name
+
+		results = append(results, result)
+		if !s.Continue {
+			blocking = append(blocking, result)
+		}
 	}
 
-	test := Cypress(src).
-		WithServiceBinding("zoo-frontend", frontendSvc).
-		WithServiceBinding("zoo-backend", backendSvc).
-		WithEnvVariable("YARN_CACHE_FOLDER", "/.yarn/cache").
-		WithMountedCache("/.yarn/cache", dag.CacheVolume("yarn-cache")).
-		WithEnvVariable("BASE_URL", "http://zoo-frontend").
-		WithExec([]string{"yarn", "run", "e2e"})
+	// Only a passed run over every package and spec verifies the sources for the publish functions.
+	if failures(results) == nil && base == "" && (spec == "" || spec == defaultSpecs) {
+		digest, err := src.Digest(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		err = markVerified(ctx, digest)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return test.Stdout(ctx)
+	return results, nil
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"dagger/dagger/internal/dagger"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+type Mongo struct {
+	// The tag of the mongo image.
+	Version string
+
+	// The cache volume where the data is kept between runs. When empty, the
+	// data is lost when the service stops.
+	Volume string
+
+	// Identifies the run the service belongs to. Services with different run
+	// ids are different services, each one with a fresh database and, when
+	// there is a volume, its own volume.
+	RunId string
+
+	// The running service, once started with 'Start', shared by every function that uses the database.
+	Svc *dagger.Service
+
+	// The scripts run when the database is created, as in '/docker-entrypoint-initdb.d'.
+	Fixtures *dagger.Directory
+
+	// The secrets needed to launch the database.
+	Secrets SecMap
+}
+
+// Returns a copy of the database that runs the given scripts when it is created. Only the '.js' and '.sh' files are run.
+func (m *Mongo) WithFixtures(fixtures *dagger.Directory) *Mongo {
+	mongo := *m
+	mongo.Fixtures = fixtures
+	mongo.Svc = nil
+
+	return &mongo
+}
+
+// Returns a copy of the database that belongs to the given run, so that it gets its own fresh database.
+func (m *Mongo) WithRunId(runId string) *Mongo {
+	mongo := *m
+	mongo.RunId = runId
+	mongo.Svc = nil
+
+	return &mongo
+}
+
+// Starts the database and returns a copy of it bound to the running service, so that 'Seed', 'Reset' and 'Dump' act on the same data, e.g. 'mongo start seed --fixtures ./fixtures'.
+func (m *Mongo) Start(ctx context.Context) (*Mongo, error) {
+	svc, err := m.Service(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	svc, err = svc.Start(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	mongo := *m
+	mongo.Svc = svc
+
+	return &mongo, nil
+}
+
+// Returns the container of the database, ready to be run as a service.
+func (m *Mongo) Ctr(ctx context.Context) (*dagger.Container, error) {
+	mongoPort, err := getMongoPort(ctx, m.Secrets.Get("MONGO_PORT"))
+	if err != nil {
+		return nil, err
+	}
+
+	ctr := dag.
+		Container().
+		From(fmt.Sprintf("mongo:%s", m.Version)).
+		WithSecretVariable("MONGO_INITDB_DATABASE", m.Secrets.Get("MONGO_DATABASE")).
+		WithSecretVariable("MONGO_INITDB_ROOT_USERNAME", m.Secrets.Get("MONGO_ROOT")).
+		WithSecretVariable("MONGO_INITDB_ROOT_PASSWORD", m.Secrets.Get("MONGO_ROOT_PASS")).
+		WithExposedPort(mongoPort)
+
+	if m.Fixtures != nil {
+		ctr = ctr.WithMountedDirectory("/docker-entrypoint-initdb.d", m.Fixtures)
+	}
+
+	if m.Volume != "" {
+		volume := m.Volume
+		if m.RunId != "" {
+			volume += "-" + m.RunId
+		}
+
+		ctr = ctr.WithMountedCache("/data/db", dag.CacheVolume(volume))
+	}
+
+	if m.RunId != "" {
+		ctr = ctr.WithEnvVariable("MONGO_RUN_ID", m.RunId)
+	}
+
+	return ctr, nil
+}
+
+// Returns the database as a service, with the "mongodb" hostname. Once started, it is the running service.
+func (m *Mongo) Service(ctx context.Context) (*dagger.Service, error) {
+	if m.Svc != nil {
+		return m.Svc, nil
+	}
+
+	ctr, err := m.Ctr(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ctr.AsService().WithHostname("mongodb"), nil
+}
+
+// Returns the connection string of the database, as a secret.
+func (m *Mongo) Uri(ctx context.Context) (*dagger.Secret, error) {
+	return createMongoUri(ctx, m.Secrets)
+}
+
+// Loads the fixtures into the running database. The '.js' files are run with mongosh and each '.json' file is imported into the collection with its name, replacing its documents.
+func (m *Mongo) Seed(ctx context.Context, fixtures *dagger.Directory) (string, error) {
+	client, err := m.client(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	script := `
+		set -eu
+		for f in /fixtures/*.js; do
+			[ -e "$f" ] || continue
+			echo "--- Running $f ---"
+			mongosh --quiet "$MONGODB_URI" "$f"
+		done
+		for f in /fixtures/*.json; do
+			[ -e "$f" ] || continue
+			echo "--- Importing $f ---"
+			mongoimport --uri "$MONGODB_URI" --collection "$(basename "$f" .json)" --drop --jsonArray --file "$f"
+		done
+	`
+
+	return client.
+		WithMountedDirectory("/fixtures", fixtures).
+		WithExec([]string{"sh", "-c", script}).
+		Stdout(ctx)
+}
+
+// Drops the database, so that the next test starts from scratch.
+func (m *Mongo) Reset(ctx context.Context) (string, error) {
+	client, err := m.client(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return client.
+		WithExec([]string{"sh", "-c", `mongosh --quiet "$MONGODB_URI" --eval "db.dropDatabase()"`}).
+		Stdout(ctx)
+}
+
+// Dumps the database, returning the directory created by mongodump.
+func (m *Mongo) Dump(ctx context.Context) (*dagger.Directory, error) {
+	client, err := m.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.
+		WithExec([]string{"sh", "-c", `mongodump --uri "$MONGODB_URI" --out /dump`}).
+		Directory("/dump"), nil
+}
+
+// client returns a container bound to the running database, with its tools and the connection string in 'MONGODB_URI'. It is never cached, since the database changes between calls.
+func (m *Mongo) client(ctx context.Context) (*dagger.Container, error) {
+	if m.Svc == nil {
+		return nil, fmt.Errorf("the database is not running, start it first")
+	}
+	svc := m.Svc
+
+	uri, err := m.Uri(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.
+		Container().
+		From(fmt.Sprintf("mongo:%s", m.Version)).
+		WithServiceBinding("mongodb", svc).
+		WithSecretVariable("MONGODB_URI", uri).
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()), nil
+}
+
+func getMongoPort(ctx context.Context, port *dagger.Secret) (int, error) {
+	mongo_portStr, err := port.Plaintext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	mongo_port, err := strconv.Atoi(mongo_portStr)
+	if err != nil {
+		return 0, err
+	}
+
+	return mongo_port, nil
+}
+
+func createMongoUri(ctx context.Context, secrets SecMap) (*dagger.Secret, error) {
+	var (
+		err       error
+		root      string
+		rootPass  string
+		mongoPort string
+		db        string
+	)
+
+	root, err = secrets.Get("MONGO_ROOT").Plaintext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rootPass, err = secrets.Get("MONGO_ROOT_PASS").Plaintext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	mongoPort, err = secrets.Get("MONGO_PORT").Plaintext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err = secrets.Get("MONGO_DATABASE").Plaintext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	mongoUri := fmt.Sprintf("mongodb://%s:%s@mongodb:%s/%s?authSource=admin",
+		root,
+		rootPass,
+		mongoPort,
+		db,
+	)
+
+	return dagger.Connect().SetSecret("mongoUri", mongoUri), nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"dagger/dagger/internal/dagger"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The registry where the packages are published by default.
+const defaultNpmRegistry = "https://npm.pkg.github.com"
+
+// The address of the local registry, as seen from the containers bound to it.
+const localNpmRegistry = "http://verdaccio:4873"
+
+// The options of the publication of a package.
+type publishOpts struct {
+	// Publish to a local Verdaccio registry instead of the default one.
+	Local bool
+
+	// The dist-tag the version is published with.
+	Tag string
+
+	// Check everything without publishing the package.
+	DryRun bool
+
+	// Do not fail when the version is already in the registry.
+	SkipExisting bool
+
+	// The running Verdaccio service the local publication goes to. By default, a new one is started.
+	Verdaccio *dagger.Service
+}
+
+// PublishPkg publishes the package with npm. The result fails, with exit code 3 and a clear error, if its version is already in the registry, unless it is skipped.
+func PublishPkg(
+	ctx context.Context,
+	base *dagger.Container,
+	pkg string,
+	pat *dagger.Secret,
+	opts publishOpts,
+) (*StageResult, error) {
+	if opts.Tag == "" {
+		opts.Tag = "latest"
+	}
+
+	registry := defaultNpmRegistry
+	ctr := base.
+		WithSecretVariable("CR_PAT", pat).
+		WithNewFile("/app/.npmrc", "//npm.pkg.github.com/:_authToken=${CR_PAT}\n")
+
+	// The registry in the 'publishConfig' of the manifest takes precedence over the '--registry' flag in some npm
+	// versions, so it is the one changed for the local publication, only inside the container.
+	setRegistry := ""
+
+	if opts.Local {
+		registry = localNpmRegistry
+		setRegistry = fmt.Sprintf("npm pkg set publishConfig.registry=%s", registry)
+
+		verdaccio := opts.Verdaccio
+		if verdaccio == nil {
+			verdaccio = VerdaccioService()
+		}
+
+		ctr = base.
+			WithServiceBinding("verdaccio", verdaccio).
+			// Verdaccio gives a token to any new user.
+			WithExec([]string{"sh", "-c", fmt.Sprintf(`
+				set -eu
+				token=$(curl -fsS -X PUT -H 'Content-Type: application/json' \
+					-d '{"name": "ci", "password": "ci"}' \
+					%s/-/user/org.couchdb.user:ci | node -p 'JSON.parse(require("fs").readFileSync(0)).token')
+				echo "//verdaccio:4873/:_authToken=${token}" > /app/.npmrc
+			`, registry)})
+	}
+
+	flags := fmt.Sprintf("--registry %s --tag %s --access restricted", registry, opts.Tag)
+	if opts.DryRun {
+		flags += " --dry-run"
+	}
+
+	script := fmt.Sprintf(`
+		set -eu
+		cd /app/packages/%[1]s
+
+		name=$(node -p 'require("./package.json").name')
+		version=$(node -p 'require("./package.json").version')
+		%[5]s
+
+		# Only a package or version that is not found is taken as not published,
+		# any other error of the registry fails.
+		echo "--- Checking if ${name}@${version} is in %[2]s ---"
+		if published=$(npm view "${name}@${version}" version --registry %[2]s 2>/tmp/npm-view.log); then
+			:
+		elif grep -q E404 /tmp/npm-view.log; then
+			published=""
+		else
+			cat /tmp/npm-view.log >&2
+			echo "Could not check if ${name}@${version} is in %[2]s" >&2
+			exit 1
+		fi
+
+		if [ -n "${published}" ]; then
+			if [ "%[3]t" = "true" ]; then
+				echo "${name}@${version} is already published in %[2]s, skipping it"
+				exit 0
+			fi
+			echo "${name}@${version} is already published in %[2]s" >&2
+			exit 3
+		fi
+
+		echo "--- Publishing ${name}@${version} ---"
+		npm publish %[4]s
+
+		if [ "%[6]t" = "true" ]; then
+			echo "--- Checking that ${name}@${version} is in %[2]s ---"
+			test "$(npm view "${name}@${version}" version --registry %[2]s)" = "${version}"
+		fi
+	`, pkg, registry, opts.SkipExisting, flags, setRegistry, opts.Local && !opts.DryRun)
+
+	var result *StageResult
+
+	attrs := []attribute.KeyValue{packageAttr.String(pkg), tagAttr.String(opts.Tag)}
+	err := stage(ctx, "publish", attrs, func(ctx context.Context) error {
+		var err error
+
+		ctr = ctr.WithEnvVariable("CACHE_BUSTER", time.Now().String())
+
+		result, err = runStage(ctx, pkg+" package", ctr, []string{"sh", "-c", script}, "")
+		if err != nil {
+			return err
+		}
+
+		return result.err()
+	})
+	if result == nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// PackPkg returns the tarball of the package, as it would be published, named 'zoo-<pkg>-<version>.tgz'.
+func PackPkg(ctx context.Context, base *dagger.Container, pkg string) (*dagger.File, error) {
+	version, err := jsonVersion(ctx, base.File(fmt.Sprintf("/app/packages/%s/package.json", pkg)))
+	if err != nil {
+		return nil, err
+	}
+
+	tarball := fmt.Sprintf("/dist/zoo-%s-%s.tgz", pkg, version)
+	script := fmt.Sprintf(`
+		set -eu
+		cd /app/packages/%s
+		mkdir -p /dist
+		npm pack --pack-destination /dist
+		mv /dist/*.tgz %s
+	`, pkg, tarball)
+
+	return base.
+		WithExec([]string{"sh", "-c", script}).
+		File(tarball), nil
+}
+
+// Publishes every package to a local Verdaccio registry, as 'publish-pkg --local' does, and returns the versions the registry serves for them, failing when any package is not there.
+func (m *Ci) PublishLocalTest(
+	ctx context.Context,
+	// +defaultPath="/"
+	src *dagger.Directory,
+) (string, error) {
+	base, err := m.Init(ctx, src)
+	if err != nil {
+		return "", err
+	}
+
+	verdaccio, err := VerdaccioService().Start(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer verdaccio.Stop(ctx)
+
+	var report strings.Builder
+	for _, pkg := range []string{"backend", "frontend"} {
+		result, err := PublishPkg(ctx, base, pkg, m.secrets["CR_PAT"], publishOpts{Local: true, Verdaccio: verdaccio})
+		if err == nil {
+			err = result.err()
+		}
+		if err != nil {
+			return "", err
+		}
+
+		// The package is looked up from another container, so it is the one in the registry and not the local one.
+		out, err := dag.
+			Container().
+			From("node:20").
+			WithServiceBinding("verdaccio", verdaccio).
+			WithFile("/package.json", base.File(fmt.Sprintf("/app/packages/%s/package.json", pkg))).
+			WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+			WithExec([]string{"sh", "-c", fmt.Sprintf(`
+				set -eu
+				name=$(node -p 'require("/package.json").name')
+				version=$(node -p 'require("/package.json").version')
+				published=$(npm view "${name}@${version}" version --registry %[1]s)
+				if [ "${published}" != "${version}" ]; then
+					echo "${name}@${version} is not in %[1]s" >&2
+					exit 1
+				fi
+				echo "${name}@${published} is in %[1]s"
+			`, localNpmRegistry)}).
+			Stdout(ctx)
+		if err != nil {
+			return "", err
+		}
+		report.WriteString(out)
+	}
+
+	return report.String(), nil
+}
+
+// VerdaccioService returns a local npm registry, reachable at port 4873.
+func VerdaccioService() *dagger.Service {
+	return dag.
+		Container().
+		From("verdaccio/verdaccio:6").
+		WithExposedPort(4873).
+		AsService(dagger.ContainerAsServiceOpts{UseEntrypoint: true})
+}
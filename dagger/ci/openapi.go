@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// The HTTP methods of the operations of a path item.
+var openApiMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// openApi is the part of an OpenAPI document needed to find breaking changes.
+type openApi struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type operation struct {
+	Parameters  []parameter  `json:"parameters"`
+	RequestBody *requestBody `json:"requestBody"`
+}
+
+type parameter struct {
+	Name     string `json:"name"`
+	In       string `json:"in"`
+	Required bool   `json:"required"`
+}
+
+type requestBody struct {
+	Required bool `json:"required"`
+	Content  map[string]struct {
+		Schema *schema `json:"schema"`
+	} `json:"content"`
+}
+
+type schema struct {
+	Ref        string             `json:"$ref"`
+	Properties map[string]*schema `json:"properties"`
+	Required   []string           `json:"required"`
+	Items      *schema            `json:"items"`
+}
+
+// breakingChanges compares two OpenAPI documents and returns the changes that
+// break the clients of the previous one: removed paths and operations, new
+// required parameters and new required fields in the request bodies.
+func breakingChanges(previous, current string) ([]string, error) {
+	prev, err := parseOpenApi(previous)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the previous OpenAPI document: %w", err)
+	}
+
+	curr, err := parseOpenApi(current)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the current OpenAPI document: %w", err)
+	}
+
+	var changes []string
+	for path, prevItem := range prev.Paths {
+		currItem, ok := curr.Paths[path]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("removed path %s", path))
+			continue
+		}
+
+		for _, method := range openApiMethods {
+			if _, ok := prevItem[method]; !ok {
+				continue
+			}
+
+			op := fmt.Sprintf("%s %s", strings.ToUpper(method), path)
+			if _, ok := currItem[method]; !ok {
+				changes = append(changes, fmt.Sprintf("removed operation %s", op))
+				continue
+			}
+
+			prevOp, err := parseOperation(prevItem, method)
+			if err != nil {
+				return nil, fmt.Errorf("parsing the previous %s: %w", op, err)
+			}
+
+			currOp, err := parseOperation(currItem, method)
+			if err != nil {
+				return nil, fmt.Errorf("parsing the current %s: %w", op, err)
+			}
+
+			changes = append(changes, operationChanges(op, prev, prevOp, curr, currOp)...)
+		}
+	}
+
+	sort.Strings(changes)
+
+	return changes, nil
+}
+
+func parseOpenApi(doc string) (*openApi, error) {
+	var spec openApi
+	if err := json.Unmarshal([]byte(doc), &spec); err != nil {
+		return nil, err
+	}
+
+	return &spec, nil
+}
+
+// parseOperation returns the operation of the path item, with the parameters
+// shared by all the operations of the path.
+func parseOperation(item map[string]json.RawMessage, method string) (*operation, error) {
+	var op operation
+	if err := json.Unmarshal(item[method], &op); err != nil {
+		return nil, err
+	}
+
+	if shared, ok := item["parameters"]; ok {
+		var params []parameter
+		if err := json.Unmarshal(shared, &params); err != nil {
+			return nil, err
+		}
+		op.Parameters = append(params, op.Parameters...)
+	}
+
+	return &op, nil
+}
+
+func operationChanges(op string, prevSpec *openApi, prev *operation, currSpec *openApi, curr *operation) []string {
+	var changes []string
+
+	for _, param := range curr.Parameters {
+		if !param.Required {
+			continue
+		}
+
+		wasRequired := slices.ContainsFunc(prev.Parameters, func(p parameter) bool {
+			return p.Name == param.Name && p.In == param.In && p.Required
+		})
+		if !wasRequired {
+			changes = append(changes, fmt.Sprintf("new required %s parameter '%s' in %s", param.In, param.Name, op))
+		}
+	}
+
+	if curr.RequestBody == nil {
+		return changes
+	}
+
+	if curr.RequestBody.Required && (prev.RequestBody == nil || !prev.RequestBody.Required) {
+		changes = append(changes, fmt.Sprintf("the request body of %s is now required", op))
+	}
+
+	for contentType, content := range curr.RequestBody.Content {
+		var prevSchema *schema
+		if prev.RequestBody != nil {
+			prevSchema = prev.RequestBody.Content[contentType].Schema
+		}
+
+		for _, field := range newRequiredFields(prevSpec, prevSchema, currSpec, content.Schema, "", 0) {
+			changes = append(changes, fmt.Sprintf("new required field '%s' in the %s request body of %s", field, contentType, op))
+		}
+	}
+
+	return changes
+}
+
+// newRequiredFields returns the fields, as dotted paths, that are required in
+// the current schema but were not in the previous one.
+func newRequiredFields(prevSpec *openApi, prev *schema, currSpec *openApi, curr *schema, prefix string, depth int) []string {
+	// Recursive schemas are only followed a few levels.
+	if depth > 10 {
+		return nil
+	}
+
+	prev = prevSpec.resolve(prev)
+	curr = currSpec.resolve(curr)
+	if curr == nil {
+		return nil
+	}
+
+	var fields []string
+	for _, name := range curr.Required {
+		if prev == nil || !slices.Contains(prev.Required, name) {
+			fields = append(fields, prefix+name)
+		}
+	}
+
+	for name, property := range curr.Properties {
+		var prevProperty *schema
+		if prev != nil {
+			prevProperty = prev.Properties[name]
+		}
+		// A new property is already reported when it is required, and it
+		// does not break the clients when it is optional.
+		if prevProperty == nil {
+			continue
+		}
+
+		fields = append(fields, newRequiredFields(prevSpec, prevProperty, currSpec, property, prefix+name+".", depth+1)...)
+	}
+
+	if curr.Items != nil {
+		var prevItems *schema
+		if prev != nil {
+			prevItems = prev.Items
+		}
+
+		fields = append(fields, newRequiredFields(prevSpec, prevItems, currSpec, curr.Items, prefix+"[].", depth+1)...)
+	}
+
+	return fields
+}
+
+// resolve follows the references to the schemas of the components.
+func (spec *openApi) resolve(s *schema) *schema {
+	for i := 0; s != nil && s.Ref != "" && i < 10; i++ {
+		name, ok := strings.CutPrefix(s.Ref, "#/components/schemas/")
+		if !ok {
+			return nil
+		}
+		s = spec.Components.Schemas[name]
+	}
+
+	return s
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+const animalsApi = `{
+  "paths": {
+    "/animals": {
+      "get": {
+        "parameters": [{"name": "species", "in": "query"}]
+      },
+      "post": {
+        "requestBody": {
+          "content": {
+            "application/json": {"schema": {"$ref": "#/components/schemas/Animal"}}
+          }
+        }
+      }
+    },
+    "/animals/{id}": {
+      "parameters": [{"name": "id", "in": "path", "required": true}],
+      "get": {},
+      "delete": {}
+    }
+  },
+  "components": {
+    "schemas": {
+      "Animal": {
+        "required": ["name"],
+        "properties": {
+          "name": {},
+          "species": {},
+          "keeper": {"properties": {"name": {}}}
+        }
+      }
+    }
+  }
+}`
+
+func TestBreakingChanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "no changes",
+			current: animalsApi,
+		},
+		{
+			name: "removed path",
+			current: `{"paths": {"/animals": {"get": {}, "post": {}}},
+			  "components": {"schemas": {"Animal": {"required": ["name"]}}}}`,
+			want: []string{"removed path /animals/{id}"},
+		},
+		{
+			name: "removed operation",
+			current: `{"paths": {
+			  "/animals": {"get": {}, "post": {}},
+			  "/animals/{id}": {"parameters": [{"name": "id", "in": "path", "required": true}], "get": {}}
+			}}`,
+			want: []string{"removed operation DELETE /animals/{id}"},
+		},
+		{
+			name: "new required parameters",
+			current: `{"paths": {
+			  "/animals": {
+			    "get": {"parameters": [{"name": "species", "in": "query", "required": true}]},
+			    "post": {}
+			  },
+			  "/animals/{id}": {
+			    "parameters": [{"name": "id", "in": "path", "required": true}, {"name": "X-Zoo", "in": "header", "required": true}],
+			    "get": {},
+			    "delete": {}
+			  }
+			}}`,
+			want: []string{
+				"new required header parameter 'X-Zoo' in DELETE /animals/{id}",
+				"new required header parameter 'X-Zoo' in GET /animals/{id}",
+				"new required query parameter 'species' in GET /animals",
+			},
+		},
+		{
+			name: "new required fields",
+			current: `{"paths": {
+			  "/animals": {
+			    "get": {},
+			    "post": {
+			      "requestBody": {
+			        "required": true,
+			        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Animal"}}}
+			      }
+			    }
+			  },
+			  "/animals/{id}": {"get": {}, "delete": {}}
+			},
+			"components": {"schemas": {
+			  "Animal": {
+			    "required": ["name", "species"],
+			    "properties": {"name": {}, "species": {}, "keeper": {"required": ["name"], "properties": {"name": {}}}}
+			  }
+			}}}`,
+			want: []string{
+				"new required field 'keeper.name' in the application/json request body of POST /animals",
+				"new required field 'species' in the application/json request body of POST /animals",
+				"the request body of POST /animals is now required",
+			},
+		},
+		{
+			name: "new optional field and path",
+			current: `{"paths": {
+			  "/animals": {
+			    "get": {},
+			    "post": {"requestBody": {"content": {"application/json": {"schema": {
+			      "required": ["name"],
+			      "properties": {"name": {}, "species": {}, "age": {}}
+			    }}}}}
+			  },
+			  "/animals/{id}": {"get": {}, "delete": {}, "put": {}},
+			  "/keepers": {"get": {}}
+			}}`,
+		},
+		{
+			name:    "invalid document",
+			current: `{"paths": [`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := breakingChanges(animalsApi, tt.current)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("breakingChanges = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"dagger/dagger/internal/dagger"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Event string
+
+const (
+	// A push to the main branch, deployed to "dev".
+	PUSH Event = "push"
+	// A release, deployed to "pro".
+	RELEASE Event = "release"
+	// A prerelease, deployed to "pre".
+	PRERELEASE Event = "prerelease"
+	// A manual run, deployed to "dev".
+	DISPATCH Event = "dispatch"
+	// A pull request, only verified.
+	PULL_REQUEST Event = "pull_request"
+)
+
+// Verifies the sources once, scans their dependencies and publishes every package with them: the Docker images with the tag, the npm packages whose version is not in the registry yet and the charts. Given the event that triggered it, the environment and the tag are derived from the event, and the new images are set in the state repository and deployed to the cluster, when there is one. The output of the result is the report of every step, and a failed deployment fails the result, which is kept, so `check` is the step that fails the run. The event can also be read from the payload sent by the CI provider, and pull requests are only verified.
+func (m *Ci) Pipeline(
+	ctx context.Context,
+	// +defaultPath="/"
+	src *dagger.Directory,
+	// The event that triggered the pipeline.
+	// +optional
+	event Event,
+	// The payload of the event, sent by GitHub Actions, GitLab or Gitea and Forgejo Actions, or the GitLab CI variables.
+	// The event, its ref, its SHA and, on a push, the previous commit are read from it, unless they are given.
+	// +optional
+	eventPayload *dagger.File,
+	// The CI provider that sent the payload.
+	// +default="auto"
+	provider Provider,
+	// Who triggered the pipeline, for the audit log of the deployments.
+	// +optional
+	actor string,
+	// The ref of the event, such as "refs/tags/v1.0.0" for a release.
+	// +optional
+	ref string,
+	// The SHA of the commit of the event.
+	// +optional
+	sha string,
+	// The tag of the Docker images. Derived from the event when it is not given.
+	// +optional
+	tag string,
+	// OCI registry to push the charts to. By default, they are pushed to a local registry.
+	// +optional
+	chartsRegistry string,
+	// Only publish the packages affected since this commit. By default, every package is published.
+	// +optional
+	base string,
+	// Commit with the changes, when only the affected packages are published.
+	// +default="HEAD"
+	head string,
+	// Snapshot of the advisory database the dependencies are scanned against. By default, a new one is downloaded.
+	// +optional
+	advisories *dagger.Directory,
+	// Docker socket of the engine where the cluster runs. Without it, nothing is deployed.
+	// +optional
+	socket *dagger.Socket,
+	// The Kind service of the cluster, e.g. tcp://127.0.0.1:3000.
+	// +optional
+	kindSvc *dagger.Service,
+	// Kind configuration of the cluster.
+	// +optional
+	clusterConfig *dagger.File,
+	// AGE private key to encrypt the secrets of the environment.
+	// +optional
+	ageKey *dagger.File,
+	// How the secrets of each environment reach the cluster, as "env=backend", e.g. "pro=external". The backends are "ksops", the default, "sealed" and "external".
+	// +optional
+	secretBackends []string,
+	// Name of the store the ExternalSecrets read from, for the environments with the "external" backend.
+	// +optional
+	secretStore string,
+) (*StageResult, error) {
+	start := time.Now()
+
+	var err error
+
+	if eventPayload != nil {
+		info, err := m.ParseEvent(ctx, eventPayload, provider)
+		if err != nil {
+			return nil, err
+		}
+
+		if event == "" {
+			event = info.Event
+		}
+		if ref == "" {
+			ref = info.Ref()
+		}
+		if sha == "" {
+			sha = info.Sha
+		}
+		// The images of a release are tagged with its name, falling back to its tag.
+		if tag == "" && info.ReleaseName != "" {
+			tag = info.ReleaseName
+		}
+		if actor == "" {
+			actor = info.Actor
+		}
+		// On a push, only the packages changed by it are published.
+		if base == "" && info.Event == PUSH {
+			base = info.Before
+		}
+	}
+
+	if event == PULL_REQUEST {
+		verified, err := m.Verify(ctx, src)
+		if err != nil {
+			return nil, err
+		}
+
+		return pipelineResult(start, section("Verified sources", verified)), nil
+	}
+
+	if event != "" && tag == "" {
+		tag, err = tagOf(event, ref, sha)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if tag == "" {
+		return nil, fmt.Errorf("a tag, or the event to derive it from, is needed")
+	}
+
+	var report strings.Builder
+
+	verified, err := m.Verify(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	report.WriteString(section("Verified sources", verified))
+	report.WriteString(section("Tag", tag))
+
+	// Every package is published with the result of this scan, against the same snapshot of the advisories.
+	if advisories == nil {
+		advisories = advisoryDb()
+	}
+
+	scan, err := m.Scan(ctx, src, advisories)
+	if err == nil {
+		err = scan.err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	report.WriteString(section("Dependencies", scan.Stdout))
+
+	back, err := m.Backend(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+
+	front, err := m.Frontend(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+
+	affected := []string{back.Name, front.Name}
+	if base != "" {
+		affected, err = m.Affected(ctx, src, base, head)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, pkg := range affected {
+		var (
+			image *StageResult
+			ctr   *dagger.Container
+		)
+
+		switch pkg {
+		case back.Name:
+			image, err = back.publishImage(ctx, tag, scan)
+			ctr = back.Base
+		case front.Name:
+			image, err = front.publishImage(ctx, tag, scan)
+			ctr = front.Base
+		default:
+			continue
+		}
+		if err == nil {
+			err = image.err()
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.WriteString(section(fmt.Sprintf("Image of %s", pkg), image.Stdout))
+
+		out, err := PublishPkg(ctx, ctr, pkg, m.secrets["CR_PAT"], publishOpts{SkipExisting: true})
+		if err == nil {
+			err = out.err()
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.WriteString(section(fmt.Sprintf("Package of %s", pkg), out.Stdout))
+	}
+
+	charts, err := m.Charts(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := charts.Publish(ctx, chartsRegistry, true)
+	if err != nil {
+		return nil, err
+	}
+	report.WriteString(section("Charts", out))
+
+	if event == "" {
+		return pipelineResult(start, report.String()), nil
+	}
+
+	env := envOf(event)
+
+	out, err = m.UpdateState(ctx, env, tag, affected)
+	if err != nil {
+		return nil, err
+	}
+	report.WriteString(section(fmt.Sprintf("State of %s", env), out))
+
+	if socket == nil || kindSvc == nil {
+		report.WriteString(section(fmt.Sprintf("Deploy to %s", env), "Skipped, there is no cluster."))
+		return pipelineResult(start, report.String()), nil
+	}
+
+	opts := dagger.CdDeployOpts{
+		AgeKey:         ageKey,
+		SecretBackends: secretBackends,
+		SecretStore:    secretStore,
+		Actor:          actor,
+		Event:          string(event),
+		Sha:            sha,
+	}
+
+	// The chart just published is deployed, unless it was pushed to the local registry, which the cluster cannot reach.
+	if chartsRegistry != "" {
+		opts.ChartsRegistry = chartsRegistry
+		opts.ChartVersion, err = charts.Version(ctx, "zoo")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The cd module records the deployment in the audit log and notifies it, whether it failed or not.
+	out, deployErr := m.deploy(ctx, env, socket, kindSvc, clusterConfig, opts)
+	if deployErr == nil {
+		report.WriteString(section(fmt.Sprintf("Deploy to %s", env), out))
+	}
+
+	// The report is returned even when the deployment failed, and 'check' fails the run.
+	if deployErr != nil {
+		result := pipelineResult(start, report.String())
+		result.Status = FAILED
+		result.ExitCode = 1
+		result.Stderr = deployErr.Error()
+		return result, nil
+	}
+
+	return pipelineResult(start, report.String()), nil
+}
+
+// pipelineResult returns the passed result of the pipeline, with the report as its output.
+func pipelineResult(start time.Time, report string) *StageResult {
+	result := newResult("pipeline", start)
+	result.Stdout = report
+
+	return result
+}
+
+// deploy renders the manifests of the environment with the cd module and pushes them to the state repository.
+func (m *Ci) deploy(
+	ctx context.Context,
+	env Envs,
+	socket *dagger.Socket,
+	kindSvc *dagger.Service,
+	clusterConfig *dagger.File,
+	opts dagger.CdDeployOpts,
+) (string, error) {
+	manifests, err := dag.
+		Cd(socket, kindSvc, dagger.CdOpts{ConfigFile: clusterConfig}).
+		Deploy(m.SecEnv, dagger.CdEnvs(env), opts).
+		Entries(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join(manifests, "\n"), nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"dagger/dagger/internal/dagger"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The result of a release, ready to be pushed.
+type Release struct {
+	// The repository with the release commit and the tags, which are not pushed.
+	Repo *dagger.Directory
+
+	// The tags created by lerna: "v0.1.0" in fixed mode, or one per released package in independent mode, e.g.
+	// "@vieites-tfg/zoo-backend@0.1.0".
+	Tags []string
+
+	// The release notes, with the changes of every released package.
+	Notes string
+
+	// The secrets needed to push the release.
+	Secrets SecMap
+}
+
+// Releases the packages with changes since their last release with `lerna version` and the conventional commits, following the mode of 'lerna.json': every package, and 'lerna.json' itself, gets the same version in fixed mode, and each one its own in independent mode. The 'package.json' and 'CHANGELOG.md' files are updated, and lerna creates the release commit and its tags. Nothing is pushed, so it can be tried on any local repository.
+func (m *Ci) Release(
+	ctx context.Context,
+	// The repository, with its '.git' directory.
+	// +defaultPath="/"
+	src *dagger.Directory,
+) (*Release, error) {
+	err := m.loadSecrets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctr := dag.
+		Container().
+		From("node:20").
+		WithDirectory("/repo", src).
+		WithWorkdir("/repo").
+		WithMountedCache("/.yarn/cache", dag.CacheVolume("yarn-cache")).
+		WithEnvVariable("YARN_CACHE_FOLDER", "/.yarn/cache").
+		WithExec([]string{"yarn", "install", "--frozen-lockfile"}).
+		WithExec([]string{"git", "config", "user.email", "dvieitest@gmail.com"}).
+		WithExec([]string{"git", "config", "user.name", "Dagger CI Bot"})
+
+	before, err := ctr.WithExec([]string{"git", "rev-parse", "HEAD"}).Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctr = ctr.
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{
+			"yarn", "lerna", "version",
+			"--conventional-commits",
+			"--no-push",
+			"--yes",
+			"--message", "chore(release): publish",
+		})
+
+	after, err := ctr.WithExec([]string{"git", "rev-parse", "HEAD"}).Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if before == after {
+		return &Release{
+			Repo:    src,
+			Notes:   "No package has changes to release.",
+			Secrets: m.releaseSecrets(),
+		}, nil
+	}
+
+	out, err := ctr.WithExec([]string{"git", "tag", "--points-at", "HEAD"}).Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	diff, err := ctr.
+		WithExec([]string{"git", "diff", "--no-color", "--unified=0", "HEAD^", "HEAD", "--", "CHANGELOG.md", "*/CHANGELOG.md"}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Release{
+		Repo:    ctr.Directory("/repo").WithoutDirectory("node_modules"),
+		Tags:    strings.Fields(out),
+		Notes:   releaseNotes(diff),
+		Secrets: m.releaseSecrets(),
+	}, nil
+}
+
+func (m *Ci) releaseSecrets() SecMap {
+	return SecMap{Keys: []string{"CR_PAT"}, Values: []*dagger.Secret{m.secrets["CR_PAT"]}}
+}
+
+// Pushes the release commit and its tags to the remote repository.
+func (r *Release) Push(
+	ctx context.Context,
+	// The repository to push to, through HTTPS.
+	// +default="github.com/vieites-tfg/zoo.git"
+	remote string,
+	// The branch to push the release commit to.
+	// +default="main"
+	branch string,
+) (string, error) {
+	if remote == "" {
+		remote = "github.com/vieites-tfg/zoo.git"
+	}
+	if branch == "" {
+		branch = "main"
+	}
+
+	if len(r.Tags) == 0 {
+		return "No release to push.", nil
+	}
+
+	script := fmt.Sprintf(`
+		set -euo pipefail
+		git push "https://${CR_PAT}@%s" "HEAD:%s"
+		for tag in %s; do
+			git push "https://${CR_PAT}@%s" "refs/tags/$tag"
+		done
+	`, remote, branch, strings.Join(r.Tags, " "), remote)
+
+	return dag.
+		Container().
+		From("node:20").
+		WithDirectory("/repo", r.Repo).
+		WithWorkdir("/repo").
+		WithSecretVariable("CR_PAT", r.Secrets.Get("CR_PAT")).
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{"bash", "-c", script}).
+		Stdout(ctx)
+}
+
+// releaseNotes returns the entries added to the changelogs by the release, under the path of each changelog, from the
+// diff of the release commit.
+func releaseNotes(diff string) string {
+	var b strings.Builder
+
+	for _, line := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			if b.Len() > 0 {
+				b.WriteString("\n")
+			}
+			fmt.Fprintf(&b, "# %s\n", strings.TrimPrefix(strings.TrimPrefix(line, "+++ "), "b/"))
+		case strings.HasPrefix(line, "+"):
+			b.WriteString(strings.TrimPrefix(line, "+") + "\n")
+		}
+	}
+
+	return b.String()
+}
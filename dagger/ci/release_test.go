@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestReleaseNotes(t *testing.T) {
+	tests := []struct {
+		name string
+		diff string
+		want string
+	}{
+		{
+			name: "no changelogs",
+		},
+		{
+			name: "new changelog",
+			diff: `diff --git a/CHANGELOG.md b/CHANGELOG.md
+new file mode 100644
+index 0000000..1b2c3d4
+--- /dev/null
++++ b/CHANGELOG.md
+@@ -0,0 +1,5 @@
++# Change Log
++
++## 0.1.0 (2026-10-19)
++
++### Features
+`,
+			want: "# CHANGELOG.md\n# Change Log\n\n## 0.1.0 (2026-10-19)\n\n### Features\n",
+		},
+		{
+			name: "entries on top of the previous ones",
+			diff: `diff --git a/packages/backend/CHANGELOG.md b/packages/backend/CHANGELOG.md
+index 1111111..2222222 100644
+--- a/packages/backend/CHANGELOG.md
++++ b/packages/backend/CHANGELOG.md
+@@ -5,0 +6,4 @@
++## 1.0.0 (2026-10-19)
++
++* **backend:** drop the notes ([abc1234](https://github.com/vieites-tfg/zoo/commit/abc1234))
++
+diff --git a/packages/frontend/CHANGELOG.md b/packages/frontend/CHANGELOG.md
+index 3333333..4444444 100644
+--- a/packages/frontend/CHANGELOG.md
++++ b/packages/frontend/CHANGELOG.md
+@@ -5,0 +6,2 @@
++## 0.2.1 (2026-10-19)
++
+`,
+			want: "# packages/backend/CHANGELOG.md\n" +
+				"## 1.0.0 (2026-10-19)\n\n" +
+				"* **backend:** drop the notes ([abc1234](https://github.com/vieites-tfg/zoo/commit/abc1234))\n\n" +
+				"\n# packages/frontend/CHANGELOG.md\n" +
+				"## 0.2.1 (2026-10-19)\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := releaseNotes(tt.diff); got != tt.want {
+				t.Errorf("releaseNotes = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
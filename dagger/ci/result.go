@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"dagger/dagger/internal/dagger"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Status string
+
+const (
+	PASSED  Status = "passed"
+	FAILED  Status = "failed"
+	SKIPPED Status = "skipped"
+)
+
+// The result of a stage of the pipeline, such as the linter or the tests of a package. A failed stage is a result too,
+// so its output and its artifacts can be read.
+type StageResult struct {
+	// The name of the stage, e.g. "backend lint".
+	Name string
+
+	// Whether the stage passed, failed or was skipped.
+	Status Status
+
+	// How long the stage took, in seconds.
+	Duration float64
+
+	// The standard output of the stage.
+	Stdout string
+
+	// The standard error of the stage.
+	Stderr string
+
+	// The exit code of the stage.
+	ExitCode int
+
+	// The number of errors reported by the stage, such as the ones of the linter.
+	Errors int
+
+	// The number of warnings reported by the stage, such as the ones of the linter.
+	Warnings int
+
+	// The files produced by the stage, such as reports or screenshots. Empty when there are none.
+	Artifacts *dagger.Directory
+
+	// The sources patched by the stage, such as the ones fixed by the linter. Empty when the stage does not patch them.
+	Fixed *dagger.Directory
+}
+
+// runStage runs the command in the container and returns its result, whatever its exit code. The artifacts are read
+// from the given path of the container, when there is one. Only the errors that are not the ones of the command, such
+// as a failed build of the container, are returned.
+func runStage(ctx context.Context, name string, ctr *dagger.Container, args []string, artifacts string) (*StageResult, error) {
+	_, result, err := execStage(ctx, name, ctr, args, artifacts)
+
+	return result, err
+}
+
+// execStage is 'runStage', but it also returns the container after the command, to read the files it changed.
+func execStage(ctx context.Context, name string, ctr *dagger.Container, args []string, artifacts string) (*dagger.Container, *StageResult, error) {
+	start := time.Now()
+
+	ctr = ctr.WithExec(args, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+
+	exitCode, err := ctr.ExitCode(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stdout, err := ctr.Stdout(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stderr, err := ctr.Stderr(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := newResult(name, start)
+	result.Stdout = stdout
+	result.Stderr = stderr
+	result.ExitCode = exitCode
+
+	if exitCode != 0 {
+		result.Status = FAILED
+	}
+
+	if artifacts != "" {
+		result.Artifacts = dag.Directory().WithDirectory(".", ctr.Directory(artifacts))
+	}
+
+	return ctr, result, nil
+}
+
+// newResult returns a passed result of a stage started at the given time, with no output.
+func newResult(name string, start time.Time) *StageResult {
+	return &StageResult{
+		Name:      name,
+		Status:    PASSED,
+		Duration:  time.Since(start).Seconds(),
+		Artifacts: dag.Directory(),
+		Fixed:     dag.Directory(),
+	}
+}
+
+// mergeResults merges the results of several runs of a stage, such as the shards of the tests or the packages of the
+// linter, into one, with the output of each run in its own section. It fails when any of them fails. The artifacts are
+// left to the caller, which knows where to put the ones of each run.
+func mergeResults(name string, start time.Time, results []*StageResult) *StageResult {
+	merged := newResult(name, start)
+
+	var stdout, stderr strings.Builder
+	for _, r := range results {
+		stdout.WriteString(section(r.Name, r.Stdout))
+		if r.Stderr != "" {
+			stderr.WriteString(section(r.Name, r.Stderr))
+		}
+
+		merged.Errors += r.Errors
+		merged.Warnings += r.Warnings
+
+		if r.Status == FAILED && merged.Status != FAILED {
+			merged.Status = FAILED
+			merged.ExitCode = r.ExitCode
+		}
+	}
+
+	merged.Stdout = stdout.String()
+	merged.Stderr = stderr.String()
+
+	return merged
+}
+
+// resultOf returns the result of a stage run through the API, such as a publication, from its output. A failed command
+// is a failed result, and any other error is returned as it is.
+func resultOf(name string, start time.Time, out string, err error) (*StageResult, error) {
+	result := newResult(name, start)
+	result.Stdout = out
+
+	var execErr *dagger.ExecError
+	if errors.As(err, &execErr) {
+		result.Status = FAILED
+		result.Stdout = execErr.Stdout
+		result.Stderr = execErr.Stderr
+		result.ExitCode = execErr.ExitCode
+		return result, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// skipped returns the result of a stage that was not run.
+func skipped(name string, reason string) *StageResult {
+	result := newResult(name, time.Now())
+	result.Status = SKIPPED
+	result.Stdout = reason
+
+	return result
+}
+
+// Returns the output of the stage, failing with it when the stage failed, e.g. 'pipeline ... check' to fail the run once the report is kept.
+func (r *StageResult) Check() (string, error) {
+	if err := r.err(); err != nil {
+		return "", err
+	}
+
+	return r.Stdout, nil
+}
+
+// err returns an error when the stage failed, with its output.
+func (r *StageResult) err() error {
+	if r.Status != FAILED {
+		return nil
+	}
+
+	return fmt.Errorf("%s failed with exit code %d:\n%s", r.Name, r.ExitCode, strings.TrimSpace(r.Stdout+"\n"+r.Stderr))
+}
+
+// The lines of the output of a failed stage kept in the error of 'failures'. The whole output is in its result.
+const failureTail = 10
+
+// failures returns an error naming every failed stage, with its exit code and the last lines of its output, if any.
+func failures(results []*StageResult) error {
+	var (
+		names   []string
+		details strings.Builder
+	)
+	for _, r := range results {
+		if r.Status != FAILED {
+			continue
+		}
+
+		names = append(names, r.Name)
+		fmt.Fprintf(&details, "\n--- %s (exit code %d) ---\n%s", r.Name, r.ExitCode, tail(strings.TrimSpace(r.Stdout+"\n"+r.Stderr), failureTail))
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("failed stages: %s%s", strings.Join(names, ", "), details.String())
+}
+
+// tail returns the last n lines of the output.
+func tail(out string, n int) string {
+	lines := strings.Split(out, "\n")
+	if len(lines) <= n {
+		return out
+	}
+
+	return "...\n" + strings.Join(lines[len(lines)-n:], "\n")
+}
+
+// failed returns the error of the first failed stage, if any.
+func failed(results []*StageResult) error {
+	for _, r := range results {
+		if err := r.err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
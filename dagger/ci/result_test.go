@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFailures(t *testing.T) {
+	long := make([]string, 30)
+	for i := range long {
+		long[i] = "line"
+	}
+	long[len(long)-1] = "last line"
+
+	tests := []struct {
+		name    string
+		results []*StageResult
+		want    string
+	}{
+		{
+			name: "none failed",
+			results: []*StageResult{
+				{Name: "backend lint", Status: PASSED},
+				{Name: "end-to-end tests", Status: SKIPPED, Stdout: "No package is affected."},
+			},
+			want: "",
+		},
+		{
+			name: "the failed stages with the end of their output",
+			results: []*StageResult{
+				{Name: "backend lint", Status: FAILED, ExitCode: 1, Stdout: "1 error"},
+				{Name: "backend typecheck", Status: PASSED},
+				{Name: "backend unit tests", Status: FAILED, ExitCode: 2, Stdout: strings.Join(long, "\n")},
+				{Name: "end-to-end tests", Status: SKIPPED, Stdout: "A previous stage failed."},
+			},
+			want: "failed stages: backend lint, backend unit tests\n" +
+				"--- backend lint (exit code 1) ---\n1 error\n" +
+				"--- backend unit tests (exit code 2) ---\n...\n" + strings.Repeat("line\n", failureTail-1) + "last line",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := failures(tt.results)
+
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.want {
+				t.Errorf("failures = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"context"
+	"dagger/dagger/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The file of the repository with the allowed and denied licenses and the advisories to ignore.
+const policyFile = "dependency-policy.json"
+
+// The snapshot of the OSV database with the advisories of the npm packages.
+const advisoryDbUrl = "https://osv-vulnerabilities.storage.googleapis.com/npm/all.zip"
+
+// The directory of the container the scanner writes its reports to.
+const scanReports = "/reports"
+
+// depsPolicy is the policy the dependencies are checked against, as in the policy file.
+type depsPolicy struct {
+	Advisories struct {
+		// The lowest severity that is a violation: "low", "moderate", "high" or "critical". Every advisory is one by
+		// default.
+		Severity string `json:"severity"`
+		// The ids, or any of their aliases, of the advisories that are not violations, e.g. "GHSA-xxxx-xxxx-xxxx".
+		Ignore []string `json:"ignore"`
+	} `json:"advisories"`
+
+	Licenses struct {
+		// The SPDX ids of the allowed licenses. Any license that is not denied is allowed when there are none.
+		Allow []string `json:"allow"`
+		// The SPDX ids of the denied licenses.
+		Deny []string `json:"deny"`
+	} `json:"licenses"`
+
+	// The packages whose license is not checked, as "name" or "name@version".
+	Exceptions []string `json:"exceptions"`
+}
+
+// The severities of the advisories, from the lowest. The advisories with no severity are ranked as the highest, so
+// that they are violations until they are reviewed and ignored.
+var severities = []string{"low", "moderate", "high", "critical", "unknown"}
+
+// osvReport is the report of OSV-Scanner, with only the fields needed to check the advisories.
+type osvReport struct {
+	Results []struct {
+		Packages []struct {
+			Package struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"package"`
+			Vulnerabilities []struct {
+				Id               string         `json:"id"`
+				Summary          string         `json:"summary"`
+				DatabaseSpecific map[string]any `json:"database_specific"`
+			} `json:"vulnerabilities"`
+			// The advisories of the package that are the same, such as a GHSA and its CVE.
+			Groups []struct {
+				Ids         []string `json:"ids"`
+				Aliases     []string `json:"aliases"`
+				MaxSeverity string   `json:"max_severity"`
+			} `json:"groups"`
+		} `json:"packages"`
+	} `json:"results"`
+}
+
+// advisoryFinding is an advisory that affects a dependency.
+type advisoryFinding struct {
+	Package  string   `json:"package"`
+	Version  string   `json:"version"`
+	Id       string   `json:"id"`
+	Aliases  []string `json:"aliases,omitempty"`
+	Severity string   `json:"severity"`
+	Summary  string   `json:"summary,omitempty"`
+	// "violation", "ignored" or "below threshold".
+	Status string `json:"status"`
+}
+
+// licenseFinding is the license of a dependency.
+type licenseFinding struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	License string `json:"license"`
+	// "allowed", "denied", "not allowed", "unknown", "exception" or "not installed", as the optional dependencies of
+	// other platforms.
+	Status string `json:"status"`
+}
+
+// The installed packages are listed by the name of their directory, which is the one in 'yarn.lock' for the aliased
+// ones, such as "string-width-cjs@npm:string-width".
+const installedLicenses = `
+const fs = require("fs");
+const path = require("path");
+
+const found = [];
+
+function license(manifest) {
+  const value = manifest.license || manifest.licenses;
+  if (Array.isArray(value)) return value.map((l) => l.type || l).join(" OR ");
+  if (value && typeof value === "object") return value.type || "";
+  return value || "";
+}
+
+function walk(dir, scope) {
+  if (!fs.existsSync(dir)) return;
+  for (const entry of fs.readdirSync(dir)) {
+    if (entry.startsWith(".")) continue;
+    const full = path.join(dir, entry);
+    if (!scope && entry.startsWith("@")) {
+      walk(full, entry);
+      continue;
+    }
+    try {
+      const manifest = JSON.parse(fs.readFileSync(path.join(full, "package.json"), "utf8"));
+      found.push({
+        package: scope ? scope + "/" + entry : entry,
+        version: manifest.version || "",
+        license: license(manifest),
+      });
+    } catch {}
+    walk(path.join(full, "node_modules"));
+  }
+}
+
+walk("/app/node_modules");
+for (const pkg of fs.readdirSync("/app/packages")) walk(path.join("/app/packages", pkg, "node_modules"));
+
+process.stdout.write(JSON.stringify(found));
+`
+
+// Downloads a snapshot of the OSV database with the advisories of the npm packages, in the layout OSV-Scanner reads offline. It can be exported and given to 'scan', to check the dependencies against the same advisories every time.
+func (m *Ci) AdvisoryDb() *dagger.Directory {
+	return advisoryDb()
+}
+
+func advisoryDb() *dagger.Directory {
+	return dag.
+		Directory().
+		WithFile("osv-scanner/npm/all.zip", dag.HTTP(advisoryDbUrl))
+}
+
+// Scans the dependencies in 'yarn.lock' for known vulnerabilities with OSV-Scanner, offline, and checks their licenses, against the policy in 'dependency-policy.json'. It returns the reports even when there are violations, which fail the result.
+func (m *Ci) Scan(
+	ctx context.Context,
+	// +defaultPath="/"
+	src *dagger.Directory,
+	// Snapshot of the advisory database, as returned by 'advisory-db'. By default, a new one is downloaded.
+	// +optional
+	advisories *dagger.Directory,
+) (*StageResult, error) {
+	base, err := m.Base(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+
+	return ScanDependencies(ctx, base, src, advisories, "")
+}
+
+// ScanDependencies scans the dependencies installed in the base container, from the lockfile of the repository, for
+// known vulnerabilities and checks their licenses, against the policy of the sources. The package, if any, is the one
+// the scan is run for, such as the one about to be published.
+func ScanDependencies(
+	ctx context.Context,
+	base *dagger.Container,
+	src *dagger.Directory,
+	advisories *dagger.Directory,
+	pkg string,
+) (*StageResult, error) {
+	if advisories == nil {
+		advisories = advisoryDb()
+	}
+
+	policy, err := readPolicy(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+
+	var attrs []attribute.KeyValue
+	if pkg != "" {
+		attrs = append(attrs, packageAttr.String(pkg))
+	}
+
+	var result *StageResult
+
+	err = stage(ctx, "scan", attrs, func(ctx context.Context) error {
+		start := time.Now()
+
+		digest, err := advisories.Digest(ctx)
+		if err != nil {
+			return err
+		}
+		setDigest(ctx, digest)
+
+		advisoryResult, findings, err := scanAdvisories(ctx, base.File("/app/yarn.lock"), advisories, policy)
+		if err != nil {
+			return err
+		}
+
+		licenses, err := checkLicenses(ctx, base, policy)
+		if err != nil {
+			return err
+		}
+
+		result, err = scanResult(start, advisoryResult, findings, licenses)
+		if err != nil {
+			return err
+		}
+
+		return result.err()
+	})
+	if result == nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// readPolicy reads the policy file of the sources. With no file, every advisory is a violation and every license is
+// allowed.
+func readPolicy(ctx context.Context, src *dagger.Directory) (depsPolicy, error) {
+	var policy depsPolicy
+	policy.Advisories.Severity = "low"
+
+	files, err := src.Glob(ctx, policyFile)
+	if err != nil {
+		return policy, err
+	}
+	if len(files) == 0 {
+		return policy, nil
+	}
+
+	content, err := src.File(policyFile).Contents(ctx)
+	if err != nil {
+		return policy, err
+	}
+
+	err = json.Unmarshal([]byte(content), &policy)
+	if err != nil {
+		return policy, fmt.Errorf("parsing '%s': %w", policyFile, err)
+	}
+
+	if !slices.Contains(severities[:len(severities)-1], strings.ToLower(policy.Advisories.Severity)) {
+		return policy, fmt.Errorf("'%s': unknown severity %q, it must be one of low, moderate, high or critical", policyFile, policy.Advisories.Severity)
+	}
+
+	return policy, nil
+}
+
+// scanAdvisories runs OSV-Scanner over the lockfile against the advisories, without reaching the network, and returns
+// its result, with its report in 'osv.json' as an artifact, and the advisories it found.
+func scanAdvisories(ctx context.Context, lockfile *dagger.File, advisories *dagger.Directory, policy depsPolicy) (*StageResult, []advisoryFinding, error) {
+	ctr := dag.
+		Container().
+		From("ghcr.io/google/osv-scanner:v2.0.2").
+		WithFile("/src/yarn.lock", lockfile).
+		WithDirectory("/advisories", advisories).
+		WithEnvVariable("OSV_SCANNER_LOCAL_DB_CACHE_DIRECTORY", "/advisories").
+		WithExec([]string{"mkdir", "-p", scanReports})
+
+	entrypoint, err := ctr.Entrypoint(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	args := append(entrypoint,
+		"scan", "source",
+		"--lockfile", "/src/yarn.lock",
+		"--offline-vulnerabilities",
+		"--format", "json",
+		"--output", scanReports+"/osv.json",
+	)
+
+	result, err := runStage(ctx, "advisories", ctr, args, scanReports)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// It exits with 1 when it finds advisories, which are checked against the policy. Any other error is kept as it is.
+	if result.ExitCode != 0 && result.ExitCode != 1 {
+		return result, nil, nil
+	}
+
+	content, err := result.Artifacts.File("osv.json").Contents(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var report osvReport
+	err = json.Unmarshal([]byte(content), &report)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing the OSV-Scanner report: %w", err)
+	}
+
+	return result, advisoryFindings(report, policy), nil
+}
+
+// advisoryFindings returns the advisories of the report, one per group of the same ones, checked against the policy.
+func advisoryFindings(report osvReport, policy depsPolicy) []advisoryFinding {
+	findings := []advisoryFinding{}
+
+	for _, res := range report.Results {
+		for _, p := range res.Packages {
+			for _, group := range p.Groups {
+				if len(group.Ids) == 0 {
+					continue
+				}
+
+				finding := advisoryFinding{
+					Package:  p.Package.Name,
+					Version:  p.Package.Version,
+					Id:       group.Ids[0],
+					Aliases:  group.Aliases,
+					Severity: "unknown",
+				}
+
+				if score, err := strconv.ParseFloat(group.MaxSeverity, 64); err == nil {
+					finding.Severity = cvssSeverity(score)
+				}
+
+				for _, vuln := range p.Vulnerabilities {
+					if vuln.Id != finding.Id {
+						continue
+					}
+					finding.Summary = vuln.Summary
+					// The GitHub advisories have their own severity, which is used when there is no CVSS score.
+					if severity, ok := vuln.DatabaseSpecific["severity"].(string); ok && finding.Severity == "unknown" {
+						finding.Severity = strings.Replace(strings.ToLower(severity), "medium", "moderate", 1)
+					}
+				}
+
+				switch {
+				case containsAny(policy.Advisories.Ignore, append([]string{finding.Id}, finding.Aliases...)):
+					finding.Status = "ignored"
+				case severityRank(finding.Severity) < severityRank(policy.Advisories.Severity):
+					finding.Status = "below threshold"
+				default:
+					finding.Status = "violation"
+				}
+
+				findings = append(findings, finding)
+			}
+		}
+	}
+
+	return findings
+}
+
+// cvssSeverity returns the severity of a CVSS score, as the GitHub advisories rate them.
+func cvssSeverity(score float64) string {
+	switch {
+	case score >= 9:
+		return "critical"
+	case score >= 7:
+		return "high"
+	case score >= 4:
+		return "moderate"
+	default:
+		return "low"
+	}
+}
+
+// severityRank returns the position of the severity in 'severities'.
+func severityRank(severity string) int {
+	for i, s := range severities {
+		if strings.EqualFold(s, severity) {
+			return i
+		}
+	}
+
+	// The severities that are not known are ranked as the ones with no severity.
+	return len(severities) - 1
+}
+
+// checkLicenses checks the license of every package in the lockfile of the base container, as read from the installed
+// ones, against the policy.
+func checkLicenses(ctx context.Context, base *dagger.Container, policy depsPolicy) ([]licenseFinding, error) {
+	lockfile, err := base.File("/app/yarn.lock").Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := base.
+		WithNewFile("/tmp/licenses.js", installedLicenses).
+		WithExec([]string{"node", "/tmp/licenses.js"}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var installed []licenseFinding
+	err = json.Unmarshal([]byte(out), &installed)
+	if err != nil {
+		return nil, fmt.Errorf("reading the licenses of the installed packages: %w", err)
+	}
+
+	licenses := map[string]string{}
+	for _, i := range installed {
+		licenses[i.Package+"@"+i.Version] = i.License
+	}
+
+	findings := []licenseFinding{}
+	for _, dep := range lockedPackages(lockfile) {
+		finding := dep
+
+		license, ok := licenses[dep.Package+"@"+dep.Version]
+		finding.License = license
+
+		switch {
+		case !ok:
+			finding.Status = "not installed"
+		case slices.Contains(policy.Exceptions, dep.Package) || slices.Contains(policy.Exceptions, dep.Package+"@"+dep.Version):
+			finding.Status = "exception"
+		default:
+			finding.Status = licenseStatus(license, policy)
+		}
+
+		findings = append(findings, finding)
+	}
+
+	return findings, nil
+}
+
+// lockedPackages returns the packages of a yarn v1 lockfile, once per version, sorted by name and version.
+func lockedPackages(lockfile string) []licenseFinding {
+	seen := map[string]bool{}
+	var packages []licenseFinding
+
+	name := ""
+	for _, line := range strings.Split(lockfile, "\n") {
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			name = ""
+
+		// The entries start with their specs, such as '"@babel/core@^7.0.0", "@babel/core@^7.1.0":'.
+		case !strings.HasPrefix(line, " ") && strings.HasSuffix(line, ":"):
+			spec := strings.Trim(strings.SplitN(strings.TrimSuffix(line, ":"), ",", 2)[0], `" `)
+			at := strings.LastIndex(spec, "@")
+			if at <= 0 {
+				name = ""
+				continue
+			}
+			// The aliased packages, such as "string-width-cjs@npm:string-width@^4.2.0", are installed with their alias.
+			name = spec[:at]
+			if alias, _, ok := strings.Cut(spec[1:], "@npm:"); ok {
+				name = spec[:1] + alias
+			}
+
+		case name != "" && strings.HasPrefix(line, "  version "):
+			version := strings.Trim(strings.TrimPrefix(line, "  version "), `"`)
+			if !seen[name+"@"+version] {
+				seen[name+"@"+version] = true
+				packages = append(packages, licenseFinding{Package: name, Version: version})
+			}
+			name = ""
+		}
+	}
+
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Package != packages[j].Package {
+			return packages[i].Package < packages[j].Package
+		}
+		return packages[i].Version < packages[j].Version
+	})
+
+	return packages
+}
+
+// licenseStatus checks an SPDX expression against the policy. It is allowed when any of its alternatives, separated by
+// "OR", has only allowed licenses, joined by "AND". Otherwise, it is denied when any of them is denied.
+func licenseStatus(expression string, policy depsPolicy) string {
+	expression = strings.NewReplacer("(", "", ")", "").Replace(strings.TrimSpace(expression))
+	if expression == "" || strings.EqualFold(expression, "UNKNOWN") || strings.HasPrefix(expression, "SEE LICENSE") {
+		return "unknown"
+	}
+
+	denied := false
+	for _, alternative := range strings.Split(expression, " OR ") {
+		allowed := true
+
+		for _, license := range strings.Split(alternative, " AND ") {
+			license = strings.TrimSpace(license)
+
+			if containsAny(policy.Licenses.Deny, []string{license}) {
+				denied = true
+				allowed = false
+				continue
+			}
+
+			if len(policy.Licenses.Allow) > 0 && !containsAny(policy.Licenses.Allow, []string{license}) {
+				allowed = false
+			}
+		}
+
+		if allowed {
+			return "allowed"
+		}
+	}
+
+	if denied {
+		return "denied"
+	}
+
+	return "not allowed"
+}
+
+// containsAny tells if any of the values is in the list, ignoring the case.
+func containsAny(list []string, values []string) bool {
+	for _, item := range list {
+		for _, value := range values {
+			if strings.EqualFold(item, value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// scanResult returns the result of the scan, which fails when there is any violation, with the findings in
+// 'advisories.json' and 'licenses.json' and the report of OSV-Scanner in 'osv.json' as artifacts.
+func scanResult(start time.Time, advisoryResult *StageResult, advisories []advisoryFinding, licenses []licenseFinding) (*StageResult, error) {
+	result := newResult("dependency scan", start)
+	result.Artifacts = advisoryResult.Artifacts
+
+	// OSV-Scanner failed by itself, so its output is kept as it is.
+	if advisories == nil {
+		result.Status = FAILED
+		result.ExitCode = advisoryResult.ExitCode
+		result.Stdout = advisoryResult.Stdout
+		result.Stderr = advisoryResult.Stderr
+		return result, nil
+	}
+
+	var violations, warnings strings.Builder
+
+	for _, a := range advisories {
+		line := fmt.Sprintf("%s@%s: %s (%s) %s\n", a.Package, a.Version, a.Id, a.Severity, a.Summary)
+		if a.Status == "violation" {
+			result.Errors++
+			violations.WriteString(line)
+		} else {
+			result.Warnings++
+			fmt.Fprintf(&warnings, "%s@%s: %s (%s), %s\n", a.Package, a.Version, a.Id, a.Severity, a.Status)
+		}
+	}
+
+	for _, l := range licenses {
+		switch l.Status {
+		case "denied", "not allowed", "unknown":
+			result.Errors++
+			fmt.Fprintf(&violations, "%s@%s: license %q is %s\n", l.Package, l.Version, l.License, l.Status)
+		case "exception":
+			result.Warnings++
+			fmt.Fprintf(&warnings, "%s@%s: license %q is not checked\n", l.Package, l.Version, l.License)
+		}
+	}
+
+	for name, findings := range map[string]any{"advisories.json": advisories, "licenses.json": licenses} {
+		report, err := json.MarshalIndent(findings, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		result.Artifacts = result.Artifacts.WithNewFile(name, string(report))
+	}
+
+	var out strings.Builder
+	if violations.Len() > 0 {
+		out.WriteString(section("Violations", violations.String()))
+	}
+	if warnings.Len() > 0 {
+		out.WriteString(section("Warnings", warnings.String()))
+	}
+	fmt.Fprintf(&out, "%d packages, %d advisories, %d violations, %d warnings\n", len(licenses), len(advisories), result.Errors, result.Warnings)
+	result.Stdout = out.String()
+
+	if result.Errors > 0 {
+		result.Status = FAILED
+		result.ExitCode = 1
+	}
+
+	return result, nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// testPolicy returns a policy with the given threshold, ignored advisories and licenses.
+func testPolicy(severity string, ignore []string, allow []string, deny []string) depsPolicy {
+	var policy depsPolicy
+	policy.Advisories.Severity = severity
+	policy.Advisories.Ignore = ignore
+	policy.Licenses.Allow = allow
+	policy.Licenses.Deny = deny
+
+	return policy
+}
+
+func TestLockedPackages(t *testing.T) {
+	tests := []struct {
+		name     string
+		lockfile string
+		want     []licenseFinding
+	}{
+		{
+			name:     "empty",
+			lockfile: "# THIS IS AN AUTOGENERATED FILE. DO NOT EDIT THIS FILE DIRECTLY.\n# yarn lockfile v1\n",
+			want:     nil,
+		},
+		{
+			name: "plain and scoped packages",
+			lockfile: `# THIS IS AN AUTOGENERATED FILE. DO NOT EDIT THIS FILE DIRECTLY.
+# yarn lockfile v1
+
+
+"@babel/core@^7.0.0", "@babel/core@^7.23.9":
+  version "7.24.0"
+  resolved "https://registry.yarnpkg.com/@babel/core/-/core-7.24.0.tgz#56cbda6b185ae9d9bed369816a8f4423c5f2ff1b"
+  integrity sha512-fQfkg0Gjkza3nf0c7/w6Xf34BW4YvzNfACRLmmb7XRLa6XHdR+K9AlJlxneFfWYf6uhOzuzZVTjF/8KfndZANw==
+  dependencies:
+    "@babel/code-frame" "^7.23.5"
+    semver "^6.3.1"
+
+ansi-regex@^5.0.1:
+  version "5.0.1"
+  resolved "https://registry.yarnpkg.com/ansi-regex/-/ansi-regex-5.0.1.tgz#082cb2c89c9fe8659a311a53bd6a4dc5301db304"
+  integrity sha512-quJQXlTSUGL2LH9SUXo8VwsY4soanhgo6LNSm84E1LBcE8s3O0wpdiRzyR9z/ZZJMlMWv37qOOb9pdJlMUEKFQ==
+`,
+			want: []licenseFinding{
+				{Package: "@babel/core", Version: "7.24.0"},
+				{Package: "ansi-regex", Version: "5.0.1"},
+			},
+		},
+		{
+			name: "aliased packages keep their alias",
+			lockfile: `"string-width-cjs@npm:string-width@^4.2.0":
+  version "4.2.3"
+
+"@isaacs/cliui-cjs@npm:@isaacs/cliui@^8.0.2":
+  version "8.0.2"
+
+"string-width@^1.0.2 || 2 || 3 || 4", string-width@^4.1.0:
+  version "4.2.3"
+`,
+			want: []licenseFinding{
+				{Package: "@isaacs/cliui-cjs", Version: "8.0.2"},
+				{Package: "string-width", Version: "4.2.3"},
+				{Package: "string-width-cjs", Version: "4.2.3"},
+			},
+		},
+		{
+			name: "one per version, sorted",
+			lockfile: `string-width@^5.0.1, string-width@^5.1.2:
+  version "5.1.2"
+
+string-width@^4.1.0:
+  version "4.2.3"
+
+string-width@^4.2.0:
+  version "4.2.3"
+`,
+			want: []licenseFinding{
+				{Package: "string-width", Version: "4.2.3"},
+				{Package: "string-width", Version: "5.1.2"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := lockedPackages(tt.lockfile)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lockedPackages = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLicenseStatus(t *testing.T) {
+	policy := testPolicy("low", nil, []string{"MIT", "Apache-2.0", "ISC"}, []string{"GPL-3.0-only", "AGPL-3.0-only"})
+	denyOnly := testPolicy("low", nil, nil, []string{"GPL-3.0-only"})
+
+	tests := []struct {
+		name       string
+		expression string
+		policy     depsPolicy
+		want       string
+	}{
+		{"allowed", "MIT", policy, "allowed"},
+		{"allowed ignoring the case", "mit", policy, "allowed"},
+		{"denied", "GPL-3.0-only", policy, "denied"},
+		{"not in the allow list", "Zlib", policy, "not allowed"},
+		{"OR with an allowed alternative", "(MIT OR GPL-3.0-only)", policy, "allowed"},
+		{"OR with only denied alternatives", "GPL-3.0-only OR AGPL-3.0-only", policy, "denied"},
+		{"OR with denied and not allowed alternatives", "GPL-3.0-only OR Zlib", policy, "denied"},
+		{"AND of allowed licenses", "MIT AND Apache-2.0", policy, "allowed"},
+		{"AND with a denied license", "MIT AND GPL-3.0-only", policy, "denied"},
+		{"AND with a license not allowed", "MIT AND Zlib", policy, "not allowed"},
+		{"OR of AND expressions", "(MIT AND Zlib) OR (ISC AND Apache-2.0)", policy, "allowed"},
+		{"no license", "", policy, "unknown"},
+		{"unknown license", "UNKNOWN", policy, "unknown"},
+		{"license in a file", "SEE LICENSE IN LICENSE.md", policy, "unknown"},
+		{"anything not denied with no allow list", "Zlib", denyOnly, "allowed"},
+		{"denied with no allow list", "GPL-3.0-only", denyOnly, "denied"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := licenseStatus(tt.expression, tt.policy); got != tt.want {
+				t.Errorf("licenseStatus(%q) = %q, want %q", tt.expression, got, tt.want)
+			}
+		})
+	}
+}
+
+// The report of OSV-Scanner, trimmed of the fields that are not read.
+const osvTestReport = `{
+  "results": [
+    {
+      "source": {"path": "/src/yarn.lock", "type": "lockfile"},
+      "packages": [
+        {
+          "package": {"name": "@babel/traverse", "version": "7.22.5", "ecosystem": "npm"},
+          "vulnerabilities": [
+            {
+              "id": "GHSA-67hx-6x53-jw92",
+              "aliases": ["CVE-2023-45133"],
+              "summary": "Babel vulnerable to arbitrary code execution when compiling specifically crafted malicious code",
+              "database_specific": {"severity": "CRITICAL"}
+            }
+          ],
+          "groups": [
+            {"ids": ["GHSA-67hx-6x53-jw92"], "aliases": ["CVE-2023-45133", "GHSA-67hx-6x53-jw92"], "max_severity": "9.3"}
+          ]
+        },
+        {
+          "package": {"name": "semver", "version": "6.3.0", "ecosystem": "npm"},
+          "vulnerabilities": [
+            {
+              "id": "GHSA-c2qf-rxjj-qqgw",
+              "aliases": ["CVE-2022-25883"],
+              "summary": "semver vulnerable to Regular Expression Denial of Service",
+              "database_specific": {"severity": "MODERATE"}
+            }
+          ],
+          "groups": [
+            {"ids": ["GHSA-c2qf-rxjj-qqgw"], "aliases": ["CVE-2022-25883", "GHSA-c2qf-rxjj-qqgw"], "max_severity": "5.3"}
+          ]
+        },
+        {
+          "package": {"name": "word-wrap", "version": "1.2.3", "ecosystem": "npm"},
+          "vulnerabilities": [
+            {
+              "id": "GHSA-j8xg-fqg3-53r7",
+              "aliases": ["CVE-2023-26115"],
+              "summary": "word-wrap vulnerable to Regular Expression Denial of Service",
+              "database_specific": {"severity": "MEDIUM"}
+            },
+            {"id": "MAL-0000-0001", "summary": "Malicious code in word-wrap"}
+          ],
+          "groups": [
+            {"ids": ["GHSA-j8xg-fqg3-53r7"], "aliases": ["CVE-2023-26115", "GHSA-j8xg-fqg3-53r7"], "max_severity": ""},
+            {"ids": ["MAL-0000-0001"], "max_severity": ""},
+            {"ids": [], "max_severity": ""}
+          ]
+        }
+      ]
+    }
+  ]
+}`
+
+func TestAdvisoryFindings(t *testing.T) {
+	var report osvReport
+	if err := json.Unmarshal([]byte(osvTestReport), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	babel := advisoryFinding{
+		Package:  "@babel/traverse",
+		Version:  "7.22.5",
+		Id:       "GHSA-67hx-6x53-jw92",
+		Aliases:  []string{"CVE-2023-45133", "GHSA-67hx-6x53-jw92"},
+		Severity: "critical",
+		Summary:  "Babel vulnerable to arbitrary code execution when compiling specifically crafted malicious code",
+	}
+	semver := advisoryFinding{
+		Package:  "semver",
+		Version:  "6.3.0",
+		Id:       "GHSA-c2qf-rxjj-qqgw",
+		Aliases:  []string{"CVE-2022-25883", "GHSA-c2qf-rxjj-qqgw"},
+		Severity: "moderate",
+		Summary:  "semver vulnerable to Regular Expression Denial of Service",
+	}
+	wordWrap := advisoryFinding{
+		Package:  "word-wrap",
+		Version:  "1.2.3",
+		Id:       "GHSA-j8xg-fqg3-53r7",
+		Aliases:  []string{"CVE-2023-26115", "GHSA-j8xg-fqg3-53r7"},
+		Severity: "moderate",
+		Summary:  "word-wrap vulnerable to Regular Expression Denial of Service",
+	}
+	malware := advisoryFinding{
+		Package:  "word-wrap",
+		Version:  "1.2.3",
+		Id:       "MAL-0000-0001",
+		Severity: "unknown",
+		Summary:  "Malicious code in word-wrap",
+	}
+
+	with := func(f advisoryFinding, status string) advisoryFinding {
+		f.Status = status
+		return f
+	}
+
+	tests := []struct {
+		name   string
+		policy depsPolicy
+		want   []advisoryFinding
+	}{
+		{
+			name:   "every advisory is a violation from low",
+			policy: testPolicy("low", nil, nil, nil),
+			want: []advisoryFinding{
+				with(babel, "violation"),
+				with(semver, "violation"),
+				with(wordWrap, "violation"),
+				with(malware, "violation"),
+			},
+		},
+		{
+			name:   "below the high threshold",
+			policy: testPolicy("high", nil, nil, nil),
+			want: []advisoryFinding{
+				with(babel, "violation"),
+				with(semver, "below threshold"),
+				with(wordWrap, "below threshold"),
+				with(malware, "violation"),
+			},
+		},
+		{
+			name:   "no severity is a violation even from critical",
+			policy: testPolicy("CRITICAL", nil, nil, nil),
+			want: []advisoryFinding{
+				with(babel, "violation"),
+				with(semver, "below threshold"),
+				with(wordWrap, "below threshold"),
+				with(malware, "violation"),
+			},
+		},
+		{
+			name:   "ignored by id or alias",
+			policy: testPolicy("low", []string{"GHSA-67hx-6x53-jw92", "cve-2022-25883", "MAL-0000-0001"}, nil, nil),
+			want: []advisoryFinding{
+				with(babel, "ignored"),
+				with(semver, "ignored"),
+				with(wordWrap, "violation"),
+				with(malware, "ignored"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := advisoryFindings(report, tt.policy)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("advisoryFindings = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type Envs string
+
+const (
+	DEV Envs = "dev"
+	PRE Envs = "pre"
+	PRO Envs = "pro"
+)
+
+// Sets the image tag of the packages in the values of the environment, in the state repository, and pushes a commit per package. The new images reach the cluster once they are deployed with the cd module, which records and notifies the deployment.
+func (m *Ci) UpdateState(
+	ctx context.Context,
+	// The environment whose values are updated.
+	env Envs,
+	// The tag of the published images.
+	tag string,
+	// The packages whose image changed. Defaults to all of them.
+	// +optional
+	packages []string,
+) (string, error) {
+	if len(packages) == 0 {
+		packages = []string{"backend", "frontend"}
+	}
+
+	err := m.loadSecrets(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	script := `
+		set -euo pipefail
+
+		echo "--- Cloning state repository ---"
+		git clone --depth 1 "https://$STATE_REPO@github.com/vieites-tfg/state.git" /state
+		cd "/state/$ENV"
+
+		for pkg in $PACKAGES; do
+			echo "--- Updating zoo-$pkg to $TAG in $ENV ---"
+			yq -i ".zoo-$pkg.image.tag = \"$TAG\"" "zoo-$pkg.yaml"
+			git add .
+			git diff --staged --quiet || git commit -m "feat(zoo-$pkg): update image to $TAG"
+		done
+	`
+
+	ctr := dag.
+		Container().
+		From("alpine:3.22").
+		WithExec([]string{"apk", "add", "--no-cache", "bash", "git", "yq"}).
+		WithExec([]string{"git", "config", "--global", "user.email", "dvieitest@gmail.com"}).
+		WithExec([]string{"git", "config", "--global", "user.name", "Dagger CI Bot"}).
+		WithSecretVariable("STATE_REPO", m.secrets["STATE_REPO"]).
+		WithEnvVariable("ENV", string(env)).
+		WithEnvVariable("TAG", tag).
+		WithEnvVariable("PACKAGES", strings.Join(packages, " ")).
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+
+	attrs := []attribute.KeyValue{envAttr.String(string(env)), tagAttr.String(tag)}
+
+	var commitOut, pushOut string
+
+	err = stage(ctx, "commit", attrs, func(ctx context.Context) error {
+		var err error
+
+		ctr = ctr.WithExec([]string{"bash", "-c", script})
+		commitOut, err = ctr.Stdout(ctx)
+		if err != nil {
+			return err
+		}
+
+		sha, err := ctr.WithWorkdir("/state").WithExec([]string{"git", "rev-parse", "HEAD"}).Stdout(ctx)
+		if err != nil {
+			return err
+		}
+		setDigest(ctx, strings.TrimSpace(sha))
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = stage(ctx, "push", attrs, func(ctx context.Context) error {
+		var err error
+		pushOut, err = ctr.
+			WithWorkdir("/state").
+			WithExec([]string{"git", "push"}).
+			Stdout(ctx)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return commitOut + pushOut, nil
+}
+
+// envOf returns the environment an event deploys to: the releases to "pro", the prereleases to "pre" and the rest to
+// "dev".
+func envOf(event Event) Envs {
+	switch event {
+	case RELEASE:
+		return PRO
+	case PRERELEASE:
+		return PRE
+	default:
+		return DEV
+	}
+}
+
+// tagOf returns the tag of the images published for an event: the name of the release, or the short commit SHA.
+func tagOf(event Event, ref string, sha string) (string, error) {
+	switch event {
+	case RELEASE, PRERELEASE:
+		tag := strings.TrimPrefix(ref, "refs/tags/")
+		if tag == "" {
+			return "", fmt.Errorf("a %s needs the ref of its tag", event)
+		}
+		return tag, nil
+	default:
+		if len(sha) < 8 {
+			return "", fmt.Errorf("a %s needs the SHA of its commit", event)
+		}
+		return sha[:8], nil
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"dagger/dagger/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The directory, relative to a package, where TypeScript keeps its incremental build info. The frontend configures it
+// in its 'tsconfig', and the backend is given the same one, so it is cached the same way for both.
+const tsBuildInfo = "node_modules/.tmp"
+
+var (
+	// A diagnostic of the compiler with '--pretty false', e.g. "src/App.vue(3,7): error TS2322: Type ...".
+	tscLocated = regexp.MustCompile(`^(.+)\((\d+),(\d+)\): (error|warning) (TS\d+): (.*)$`)
+	// A diagnostic not tied to a file, such as a wrong configuration, e.g. "error TS5083: Cannot read file ...".
+	tscGlobal = regexp.MustCompile(`^(error|warning) (TS\d+): (.*)$`)
+)
+
+// Typecheck runs the TypeScript compiler over the package without emitting any file, and returns its result, even when
+// there are errors, with the diagnostics in 'tsc.json' and 'tsc.sarif' as artifacts. The incremental build info is kept
+// in a cache volume, so only the files that changed are checked again.
+func Typecheck(ctx context.Context, base *dagger.Container, pkg string, args []string) (*StageResult, error) {
+	dir := fmt.Sprintf("/app/packages/%s", pkg)
+
+	ctr := base.
+		WithMountedCache(dir+"/"+tsBuildInfo, dag.CacheVolume("tsbuildinfo-"+pkg)).
+		WithWorkdir(dir)
+
+	result, err := runStage(ctx, pkg+" typecheck", ctr, args, "")
+	if err != nil {
+		return nil, err
+	}
+
+	diags := tscDiagnostics(pkg, result.Stdout)
+	for _, d := range diags {
+		if d.Severity == "error" {
+			result.Errors++
+		} else {
+			result.Warnings++
+		}
+	}
+
+	report, err := json.MarshalIndent(diags, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	sarif, err := toSarif("TypeScript", "https://www.typescriptlang.org", diags)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Artifacts = result.Artifacts.
+		WithNewFile("tsc.json", string(report)).
+		WithNewFile("tsc.sarif", sarif)
+
+	// Anything the compiler printed that is not a diagnostic, such as a crash, is kept as it is.
+	if len(diags) > 0 || result.Status != FAILED {
+		result.Stdout = diagnosticsSummary(diags, result.Errors, result.Warnings)
+	}
+
+	return result, nil
+}
+
+// tscDiagnostics parses the output of the compiler with '--pretty false', where the paths are relative to the package,
+// and returns its diagnostics with the paths relative to the root of the repository. The lines of the messages that
+// span several of them are indented, and are joined to the message they belong to.
+func tscDiagnostics(pkg string, out string) []diagnostic {
+	diags := []diagnostic{}
+
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		if m := tscLocated.FindStringSubmatch(line); m != nil {
+			lineNumber, _ := strconv.Atoi(m[2])
+			column, _ := strconv.Atoi(m[3])
+
+			diags = append(diags, diagnostic{
+				File:     fmt.Sprintf("packages/%s/%s", pkg, m[1]),
+				Line:     lineNumber,
+				Column:   column,
+				Severity: m[4],
+				Rule:     m[5],
+				Message:  m[6],
+			})
+			continue
+		}
+
+		if m := tscGlobal.FindStringSubmatch(line); m != nil {
+			diags = append(diags, diagnostic{
+				File:     fmt.Sprintf("packages/%s", pkg),
+				Severity: m[1],
+				Rule:     m[2],
+				Message:  m[3],
+			})
+			continue
+		}
+
+		if strings.HasPrefix(line, " ") && len(diags) > 0 {
+			last := &diags[len(diags)-1]
+			last.Message += "\n" + strings.TrimSpace(line)
+		}
+	}
+
+	return diags
+}
+
+// Checks the types of the backend with 'tsc', without emitting any file, and returns the diagnostics as JSON and SARIF artifacts, even when it fails.
+func (m *Backend) Typecheck(ctx context.Context) (*StageResult, error) {
+	return Typecheck(ctx, m.Base, m.Name, []string{
+		"npx", "tsc", "--noEmit", "--incremental",
+		"--tsBuildInfoFile", tsBuildInfo + "/tsconfig.tsbuildinfo",
+		"--pretty", "false",
+	})
+}
+
+// Checks the types of the frontend, '.vue' files included, with 'vue-tsc' over every project of its 'tsconfig', and returns the diagnostics as JSON and SARIF artifacts, even when it fails.
+func (m *Frontend) Typecheck(ctx context.Context) (*StageResult, error) {
+	// The projects do not emit, and keep their build info in 'node_modules/.tmp', as set in their configuration.
+	return Typecheck(ctx, m.Base, m.Name, []string{"npx", "vue-tsc", "--build", "--pretty", "false"})
+}
@@ -3,9 +3,13 @@ package main
 import (
 	"context"
 	"dagger/dagger/internal/dagger"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type secrets map[string]*dagger.Secret
@@ -59,38 +63,92 @@ func PublishImage(
 	pkg string,
 	sec *dagger.Secret,
 	tag string,
-) (string, error) {
-	return image.
-		WithRegistryAuth("ghcr.io", "vieitesss", sec).
-		Publish(ctx, fmt.Sprintf("ghcr.io/vieites-tfg/zoo-%s:%s", pkg, tag))
+) (*StageResult, error) {
+	var result *StageResult
+
+	attrs := []attribute.KeyValue{packageAttr.String(pkg), tagAttr.String(tag)}
+	err := stage(ctx, "publish", attrs, func(ctx context.Context) error {
+		start := time.Now()
+
+		ref, err := image.
+			WithRegistryAuth("ghcr.io", "vieitesss", sec).
+			Publish(ctx, fmt.Sprintf("ghcr.io/vieites-tfg/zoo-%s:%s", pkg, tag))
+
+		result, err = resultOf(pkg+" image", start, ref, err)
+		if err != nil {
+			return err
+		}
+
+		if _, digest, ok := strings.Cut(ref, "@"); ok {
+			setDigest(ctx, digest)
+		}
+
+		return result.err()
+	})
+	if result == nil {
+		return nil, err
+	}
+
+	return result, nil
 }
 
-func Lint(ctx context.Context, base *dagger.Container, pkg string) (string, error) {
-	return base.
-		WithWorkdir(fmt.Sprintf("/app/packages/%s", pkg)).
-		WithExec([]string{"yarn", "lint"}).
-		Stdout(ctx)
+// PackageVersion returns the version in the 'package.json' of the package.
+func PackageVersion(ctx context.Context, src *dagger.Directory, pkg string) (string, error) {
+	return jsonVersion(ctx, src.File(fmt.Sprintf("packages/%s/package.json", pkg)))
 }
 
-func PublishPkg(
-	ctx context.Context,
-	base *dagger.Container,
-	pkg string,
-	pat *dagger.Secret,
-) (string, error) {
-	return base.
-		WithSecretVariable("CR_PAT", pat).
-		WithNewFile("/app/.npmrc", "//npm.pkg.github.com/:_authToken=${CR_PAT}\n").
-		WithExec([]string{"yarn", "publish", "--access", "restricted", fmt.Sprintf("/app/packages/%s", pkg), "--non-interactive"}).
-		Stdout(ctx)
+// jsonVersion returns the "version" field of a JSON file, such as 'package.json' or 'lerna.json'.
+func jsonVersion(ctx context.Context, file *dagger.File) (string, error) {
+	content, err := file.Contents(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var manifest struct {
+		Version string `json:"version"`
+	}
+
+	err = json.Unmarshal([]byte(content), &manifest)
+	if err != nil {
+		return "", err
+	}
+
+	if manifest.Version == "" {
+		return "", fmt.Errorf("no version found")
+	}
+
+	return manifest.Version, nil
+}
+
+// dependencyVersion returns the version of a dependency, or a dev dependency, in a 'package.json'.
+func dependencyVersion(ctx context.Context, file *dagger.File, name string) (string, error) {
+	content, err := file.Contents(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var manifest struct {
+		Dependencies    map[string]string `json:"dependencies"`
+		DevDependencies map[string]string `json:"devDependencies"`
+	}
+
+	err = json.Unmarshal([]byte(content), &manifest)
+	if err != nil {
+		return "", err
+	}
+
+	if version, ok := manifest.Dependencies[name]; ok {
+		return version, nil
+	}
+
+	if version, ok := manifest.DevDependencies[name]; ok {
+		return version, nil
+	}
+
+	return "", fmt.Errorf("no %s dependency found", name)
 }
 
-func Cypress(src *dagger.Directory) *dagger.Container {
-	return dagger.Connect().
-		Container().
-		From("cypress/browsers").
-		WithMountedDirectory("/e2e", src).
-		WithWorkdir("/e2e").
-		WithExec([]string{"npx", "cypress", "install"}).
-		WithExec([]string{"yarn", "add", "lerna@8.2.1", "-W"})
+// section returns the output of a stage with a header, to be part of a report.
+func section(title string, out string) string {
+	return fmt.Sprintf("--- %s ---\n%s\n", title, out)
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"dagger/dagger/internal/dagger"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The cache volume that keeps, for the digest of every source that passed 'Endtoend', the token issued for it.
+const verifiedVolume = "zoo-verified-tokens"
+
+// Runs 'Endtoend' over the sources, unless they already passed it, and returns the token that tells the publish functions that they are verified. The token is random and recorded along with the digest of the sources when they pass, so it is only valid for them and cannot be computed without running it. When a stage of 'Endtoend' fails, it fails with the names of the failed stages and the end of their output.
+func (m *Ci) Verify(
+	ctx context.Context,
+	// +defaultPath="/"
+	src *dagger.Directory,
+) (string, error) {
+	digest, err := src.Digest(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := verifiedToken(ctx, digest)
+	if err != nil {
+		return "", err
+	}
+
+	if token == "" {
+		results, err := m.Endtoend(ctx, src, ELECTRON, defaultSpecs, 0, 1, "", "")
+		if err != nil {
+			return "", err
+		}
+
+		err = failures(results)
+		if err != nil {
+			return "", err
+		}
+
+		token, err = verifiedToken(ctx, digest)
+		if err != nil {
+			return "", err
+		}
+		if token == "" {
+			return "", fmt.Errorf("the sources passed 'Endtoend' but no token was recorded for them")
+		}
+	}
+
+	return token, nil
+}
+
+// isVerified tells if the sources passed 'Endtoend', in this run or in a previous one. When a token is given, it also
+// has to be the one recorded for them.
+func isVerified(ctx context.Context, src *dagger.Directory, token string) (bool, error) {
+	digest, err := src.Digest(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	recorded, err := verifiedToken(ctx, digest)
+	if err != nil || recorded == "" {
+		return false, err
+	}
+
+	if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(recorded)) != 1 {
+		return false, fmt.Errorf("the token is not the one issued by 'verify' for the sources")
+	}
+
+	return true, nil
+}
+
+// verifiedToken returns the token recorded for the sources with the digest, or an empty string if they did not pass
+// 'Endtoend'.
+func verifiedToken(ctx context.Context, digest string) (string, error) {
+	out, err := verifiedCtr().
+		WithExec([]string{"sh", "-c", fmt.Sprintf("cat /verified/%s 2>/dev/null || true", verifiedName(digest))}).
+		Stdout(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(out), nil
+}
+
+// markVerified records that the sources with the digest passed 'Endtoend', with a new random token. The token of a
+// previous run is kept, so the ones already issued stay valid.
+func markVerified(ctx context.Context, digest string) error {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	_, err := verifiedCtr().
+		WithEnvVariable("TOKEN", hex.EncodeToString(nonce)).
+		WithExec([]string{"sh", "-c", fmt.Sprintf(`
+			set -eu
+			# The link fails when another run already recorded its token.
+			tmp=$(mktemp /verified/.token.XXXXXX)
+			echo "$TOKEN" > "$tmp"
+			ln "$tmp" /verified/%[1]s 2>/dev/null || true
+			rm "$tmp"
+		`, verifiedName(digest))}).
+		Sync(ctx)
+
+	return err
+}
+
+// verifiedCtr returns a container with the tokens of the verified digests in '/verified'. It is never cached, since
+// the volume changes between calls.
+func verifiedCtr() *dagger.Container {
+	return dag.
+		Container().
+		From("alpine:3.22").
+		WithMountedCache("/verified", dag.CacheVolume(verifiedVolume)).
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+}
+
+func verifiedName(digest string) string {
+	return strings.TrimPrefix(digest, "sha256:")
+}
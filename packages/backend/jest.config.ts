@@ -1,13 +1,28 @@
 import type { Config } from '@jest/types';
 
-const config: Config.InitialOptions = {
+const project: Config.InitialProjectOptions = {
   preset: 'ts-jest',
   testEnvironment: 'node',
-  verbose: true,
   transform: {
     '^.+\\.tsx?$': 'ts-jest',
   },
 };
 
-export default config;
+const config: Config.InitialOptions = {
+  verbose: true,
+  projects: [
+    {
+      ...project,
+      displayName: 'unit',
+      testMatch: ['<rootDir>/tests/unit/**/*.test.ts'],
+    },
+    {
+      // Needs a running database in MONGODB_URI.
+      ...project,
+      displayName: 'integration',
+      testMatch: ['<rootDir>/tests/integration/**/*.test.ts'],
+    },
+  ],
+};
 
+export default config;
@@ -33,6 +33,9 @@ const swaggerOptions = {
 };
 
 const swaggerDocs = swaggerJsDoc(swaggerOptions);
+app.get('/api-docs.json', (req, res) => {
+  res.json(swaggerDocs);
+});
 app.use('/api-docs', swaggerUi.serve, swaggerUi.setup(swaggerDocs));
 
 app.use('/animals', animalsRouter);
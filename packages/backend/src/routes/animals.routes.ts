@@ -189,6 +189,8 @@ router.post('/', async (req: Request, res: Response): Promise<void> => {
  *     responses:
  *       200:
  *         description: Animal updated successfully
+ *       400:
+ *         description: Error validating the input data
  *       404:
  *         description: Animal not found
  *       500:
@@ -241,6 +243,11 @@ router.put('/:id', async (req: Request, res: Response): Promise<void> => {
  */
 router.delete('/:id', async (req: Request, res: Response): Promise<void> => {
   try {
+    if (!Types.ObjectId.isValid(req.params.id)) {
+      res.status(404).json({ error: 'Animal not found' });
+      return;
+    }
+
     const deletedAnimal = await AnimalService.deleteAnimal(req.params.id);
     if (!deletedAnimal) {
       res.status(404).json({ error: 'Animal not found' });
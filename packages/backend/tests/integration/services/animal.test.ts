@@ -0,0 +1,92 @@
+import { Animal } from '../../../src/models/animal.model';
+import { AnimalService } from '../../../src/services/animal.service';
+import { IAnimal } from '../../../src/models/animal.model';
+import mongoose from 'mongoose';
+
+describe('AnimalService Integration Tests', () => {
+  const animalData: IAnimal = {
+    name: 'Tiger',
+    species: 'Panthera tigris',
+    birthday: new Date('2016-03-03'),
+    genre: 'Male',
+    diet: 'Carnivore',
+    condition: 'Healthy',
+    notes: 'Created by the integration tests',
+  };
+
+  beforeAll(async () => {
+    const uri = process.env.MONGODB_URI;
+    if (!uri) {
+      throw new Error('MONGODB_URI must be set to run the integration tests');
+    }
+
+    await mongoose.connect(uri);
+  });
+
+  afterEach(async () => {
+    await Animal.deleteMany({ notes: animalData.notes });
+  });
+
+  afterAll(async () => {
+    await mongoose.disconnect();
+  });
+
+  describe('createAnimal', () => {
+    it('should store the animal in the database', async () => {
+      const created = await AnimalService.createAnimal(animalData);
+
+      const found = await Animal.findById(created._id);
+      expect(found).not.toBeNull();
+      expect(found?.name).toBe(animalData.name);
+      expect(found?.birthday).toEqual(animalData.birthday);
+    });
+  });
+
+  describe('getAllAnimals', () => {
+    it('should include the stored animals', async () => {
+      const created = await AnimalService.createAnimal(animalData);
+
+      const animals = await AnimalService.getAllAnimals();
+
+      expect(animals.map((a) => a.id)).toContain(created.id);
+    });
+  });
+
+  describe('getAnimalById', () => {
+    it('should return the stored animal', async () => {
+      const created = await AnimalService.createAnimal(animalData);
+
+      const result = await AnimalService.getAnimalById(created.id);
+
+      expect(result?.species).toBe(animalData.species);
+    });
+
+    it('should return null when the animal does not exist', async () => {
+      const result = await AnimalService.getAnimalById(new mongoose.Types.ObjectId().toString());
+
+      expect(result).toBeNull();
+    });
+  });
+
+  describe('updateAnimal', () => {
+    it('should update the stored animal and return the new document', async () => {
+      const created = await AnimalService.createAnimal(animalData);
+
+      const result = await AnimalService.updateAnimal(created.id, { condition: 'Injured' });
+
+      expect(result?.condition).toBe('Injured');
+      expect((await Animal.findById(created._id))?.condition).toBe('Injured');
+    });
+  });
+
+  describe('deleteAnimal', () => {
+    it('should remove the animal from the database', async () => {
+      const created = await AnimalService.createAnimal(animalData);
+
+      const result = await AnimalService.deleteAnimal(created.id);
+
+      expect(result?.id).toBe(created.id);
+      expect(await Animal.findById(created._id)).toBeNull();
+    });
+  });
+});
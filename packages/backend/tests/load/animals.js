@@ -0,0 +1,126 @@
+import http from 'k6/http';
+import { check, group, sleep } from 'k6';
+
+// Run with `k6 run tests/load/animals.js`. BASE_URL points to the backend and
+// the SLO thresholds can be changed with P95_MS, P99_MS and MAX_ERROR_RATE.
+const BASE_URL = __ENV.BASE_URL || 'http://localhost:3000';
+const P95_MS = __ENV.P95_MS || '300';
+const P99_MS = __ENV.P99_MS || '800';
+const MAX_ERROR_RATE = __ENV.MAX_ERROR_RATE || '0.01';
+
+export const options = {
+  scenarios: {
+    crud: {
+      executor: 'ramping-vus',
+      startVUs: 1,
+      stages: [
+        { duration: __ENV.RAMP_UP || '10s', target: Number(__ENV.VUS || 10) },
+        { duration: __ENV.DURATION || '30s', target: Number(__ENV.VUS || 10) },
+        { duration: '5s', target: 0 },
+      ],
+    },
+  },
+  // The summary only has these stats, and the default ones have no p(99).
+  summaryTrendStats: ['avg', 'min', 'med', 'max', 'p(90)', 'p(95)', 'p(99)'],
+  thresholds: {
+    http_req_duration: [`p(95)<${P95_MS}`, `p(99)<${P99_MS}`],
+    http_req_failed: [`rate<${MAX_ERROR_RATE}`],
+  },
+};
+
+const headers = { 'Content-Type': 'application/json' };
+
+export default function () {
+  let id;
+
+  group('list', () => {
+    const res = http.get(`${BASE_URL}/animals`, { tags: { name: 'GET /animals' } });
+    check(res, { 'list is 200': (r) => r.status === 200 });
+  });
+
+  group('create', () => {
+    const animal = {
+      name: `Load ${__VU}-${__ITER}`,
+      species: 'Panthera leo',
+      birthday: '2020-01-01',
+      genre: 'female',
+      diet: 'Carnivore',
+      condition: 'Healthy',
+      notes: 'Created by the load test',
+    };
+    const res = http.post(`${BASE_URL}/animals`, JSON.stringify(animal), {
+      headers,
+      tags: { name: 'POST /animals' },
+    });
+    check(res, { 'create is 201': (r) => r.status === 201 });
+    id = res.status === 201 ? res.json('_id') : undefined;
+  });
+
+  if (!id) {
+    return;
+  }
+
+  group('read', () => {
+    const res = http.get(`${BASE_URL}/animals/${id}`, { tags: { name: 'GET /animals/:id' } });
+    check(res, { 'read is 200': (r) => r.status === 200 });
+  });
+
+  group('update', () => {
+    const res = http.put(`${BASE_URL}/animals/${id}`, JSON.stringify({ condition: 'Sick' }), {
+      headers,
+      tags: { name: 'PUT /animals/:id' },
+    });
+    check(res, { 'update is 200': (r) => r.status === 200 });
+  });
+
+  group('delete', () => {
+    const res = http.del(`${BASE_URL}/animals/${id}`, null, { tags: { name: 'DELETE /animals/:id' } });
+    check(res, { 'delete is 200': (r) => r.status === 200 });
+  });
+
+  sleep(1);
+}
+
+function trend(metric) {
+  const values = metric ? metric.values : {};
+  return {
+    avg: values.avg,
+    min: values.min,
+    med: values.med,
+    max: values.max,
+    p90: values['p(90)'],
+    p95: values['p(95)'],
+    p99: values['p(99)'],
+  };
+}
+
+function thresholds(metrics) {
+  const result = {};
+  for (const name of Object.keys(options.thresholds)) {
+    const metric = metrics[name];
+    result[name] = {};
+    for (const [threshold, value] of Object.entries((metric && metric.thresholds) || {})) {
+      result[name][threshold] = value.ok;
+    }
+  }
+  return result;
+}
+
+// Writes the latency percentiles and the error rates as JSON, along with the
+// result of each threshold.
+export function handleSummary(data) {
+  const metrics = data.metrics;
+  const summary = {
+    requests: metrics.http_reqs ? metrics.http_reqs.values.count : 0,
+    rps: metrics.http_reqs ? metrics.http_reqs.values.rate : 0,
+    latency_ms: trend(metrics.http_req_duration),
+    error_rate: metrics.http_req_failed ? metrics.http_req_failed.values.rate : 0,
+    checks_rate: metrics.checks ? metrics.checks.values.rate : 0,
+    thresholds: thresholds(metrics),
+  };
+
+  return {
+    stdout: JSON.stringify(summary, null, 2) + '\n',
+    [__ENV.SUMMARY_FILE || 'summary.json']: JSON.stringify(summary, null, 2),
+  };
+}
@@ -51,10 +51,7 @@ to_local () {
 
 	for p in $1
 	do
-		cd "$ROOT/packages/$p"
-		version=$(node -p "require('./package.json').version")
-		yarn pack --filename "$LOCAL/zoo-${p}-${version}.tgz"
-		cd "$ROOT"
+		dagger call -m "$ROOT/../dagger/ci" --sec-env=file://"$ROOT/../.env" "$p" pack export --path "$LOCAL/"
 	done
 }
 